@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// songCache is an on-disk cache of songs, bounded in size: the least
+// recently used songs are evicted first. Songs are added only once
+// downloaded completely, and atomically, so a file in the cache is
+// always a whole song. The access order survives restarts, as it is
+// kept in the modification times of the files.
+type songCache struct {
+	dir string
+	max int64
+
+	mu   sync.Mutex
+	size int64
+	lru  *list.List // of *cacheEntry, most recently used first
+	m    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+const tmpSuffix = ".tmp"
+
+// openCache opens the cache in dir, creating it if needed, and trims
+// it to max bytes. Leftovers of interrupted downloads are removed.
+func openCache(dir string, max int64) (*songCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &songCache{
+		dir: dir,
+		max: max,
+		lru: list.New(),
+		m:   make(map[string]*list.Element),
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		switch {
+		case strings.HasSuffix(fi.Name(), tmpSuffix):
+			os.Remove(filepath.Join(dir, fi.Name()))
+		case fi.Mode().IsRegular():
+			c.m[fi.Name()] = c.lru.PushBack(&cacheEntry{fi.Name(), fi.Size()})
+			c.size += fi.Size()
+		}
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// cacheKey returns the cache key of a song transferred in the given
+// format and bitrate. Song ids are opaque, so they are hashed into
+// something usable as a file name.
+func cacheKey(id, format string, bitrate int) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", id, format, bitrate))))
+}
+
+// open returns the cached song with the given key, or an error
+// satisfying os.IsNotExist if there is none.
+func (c *songCache) open(key string) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(c.dir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		// removed behind our back
+		c.remove(e)
+		return nil, err
+	}
+	c.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, nil
+}
+
+// has reports whether the song with the given key is in the cache.
+func (c *songCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.m[key]
+	return ok
+}
+
+// create starts adding the song with the given key.
+func (c *songCache) create(key string) (*cacheWriter, error) {
+	f, err := ioutil.TempFile(c.dir, key+".*"+tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{c: c, key: key, f: f}, nil
+}
+
+// remove removes e from the cache. c.mu must be held.
+func (c *songCache) remove(e *list.Element) {
+	ce := c.lru.Remove(e).(*cacheEntry)
+	delete(c.m, ce.key)
+	c.size -= ce.size
+	os.Remove(filepath.Join(c.dir, ce.key))
+}
+
+// evict removes the least recently used songs until the cache fits its
+// maximum size. c.mu must be held.
+func (c *songCache) evict() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// cacheWriter writes a song into the cache. The song is not visible
+// until commit.
+type cacheWriter struct {
+	c   *songCache
+	key string
+	f   *os.File
+	n   int64
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// commit adds the written song to the cache.
+func (w *cacheWriter) commit() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w.n > c.max {
+		os.Remove(w.f.Name())
+		return nil
+	}
+	if err := os.Rename(w.f.Name(), filepath.Join(c.dir, w.key)); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if e, ok := c.m[w.key]; ok {
+		// raced with another download of the same song
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.m[w.key] = c.lru.PushFront(&cacheEntry{w.key, w.n})
+	c.size += w.n
+	c.evict()
+	return nil
+}
+
+// abort discards the written data.
+func (w *cacheWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func put(t *testing.T, c *songCache, key, data string) {
+	w, err := c.create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.open(key); !os.IsNotExist(err) {
+		t.Error(key, "visible before commit")
+	}
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(c *songCache, key string) (string, bool) {
+	f, err := c.open(key)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "a", "aaaa")
+	put(t, c, "b", "bbbb")
+	if s, ok := get(c, "a"); !ok || s != "aaaa" {
+		t.Error("a:", s, ok)
+	}
+	put(t, c, "c", "cccc") // evicts b, the least recently used
+	if _, ok := get(c, "b"); ok {
+		t.Error("b not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := get(c, k); !ok {
+			t.Error(k, "evicted")
+		}
+	}
+	if c.size != 8 {
+		t.Error(c.size, "≠", 8)
+	}
+
+	// too big to be cached:
+	put(t, c, "d", strings.Repeat("d", 11))
+	if _, ok := get(c, "d"); ok {
+		t.Error("d cached")
+	}
+
+	// aborted writes leave nothing behind:
+	w, err := c.create("e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ee"))
+	w.abort()
+	if _, ok := get(c, "e"); ok {
+		t.Error("e cached")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Error(len(files), "files in cache ≠", 2)
+	}
+}
+
+func TestCacheReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, c, "old", "1234")
+	put(t, c, "new", "5678")
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "old"), past, past)
+	if err := ioutil.WriteFile(filepath.Join(dir, "x"+tmpSuffix), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the least recently used song goes first
+	c, err = openCache(dir, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := get(c, "old"); ok {
+		t.Error("old not evicted")
+	}
+	if s, ok := get(c, "new"); !ok || s != "5678" {
+		t.Error("new:", s, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x"+tmpSuffix)); !os.IsNotExist(err) {
+		t.Error("partial download not removed")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	k := cacheKey("al/1", "stream", 128)
+	if strings.ContainsAny(k, "/\x00") {
+		t.Error("unsafe key", k)
+	}
+	if k == cacheKey("al/1", "stream", 192) || k == cacheKey("al/1", "raw", 128) {
+		t.Error("key collision")
+	}
+}
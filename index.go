@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+
+	"strings"
+	"unicode"
+)
+
+// otherIndex holds the artists whose name does not start with a letter.
+const otherIndex = "@" // subsonic uses '#', but I don't like it.
+
+// indexName returns the name of the index directory holding artist,
+// according to the -index flag:
+//
+//	fold	a-z, after diacritic folding and transliteration of
+//		Greek and Cyrillic initials
+//	script	like fold for the Latin script, one directory per
+//		script (e.g. "cyrillic") for the others
+//	server	the index names sent by the server
+func indexName(artist subsonic.Artist) string {
+	if *idxmode == "server" {
+		if artist.Index == "" || artist.Index == "#" {
+			return otherIndex
+		}
+		return dotName(tr(artist.Index))
+	}
+	r, ok := initial(artist.Name)
+	if !ok {
+		return otherIndex
+	}
+	r = fold(r)
+	if *idxmode == "script" && r > unicode.MaxASCII {
+		if s := script(r); s != "" {
+			return s
+		}
+	}
+	if t, ok := translit[r]; ok {
+		r = t
+	}
+	if r < 'a' || r > 'z' {
+		return otherIndex
+	}
+	return string(r)
+}
+
+// initial returns the first rune of s, lowercased, if it is a letter.
+func initial(s string) (rune, bool) {
+	for _, r := range s {
+		return unicode.ToLower(r), unicode.IsLetter(r)
+	}
+	return 0, false
+}
+
+// fold removes the diacritics from r: é becomes e, й becomes и.
+func fold(r rune) rune {
+	if b, ok := bases[r]; ok {
+		r = b
+	}
+	if f, ok := foldings[r]; ok {
+		return f
+	}
+	return r
+}
+
+// decompositions holds, by base letter, the lowercase Latin, Greek and
+// Cyrillic letters which decompose into it and diacritics (see Unicode
+// NFD).
+var decompositions = map[rune]string{
+	'a': "àáâãäåāăąǎǟǡǻȁȃȧḁạảấầẩẫậắằẳẵặ",
+	'b': "ḃḅḇ",
+	'c': "çćĉċčḉ",
+	'd': "ďḋḍḏḑḓ",
+	'e': "èéêëēĕėęěȅȇȩḕḗḙḛḝẹẻẽếềểễệ",
+	'f': "ḟ",
+	'g': "ĝğġģǧǵḡ",
+	'h': "ĥȟḣḥḧḩḫẖ",
+	'i': "ìíîïĩīĭįǐȉȋḭḯỉị",
+	'j': "ĵǰ",
+	'k': "ķǩḱḳḵ",
+	'l': "ĺļľḷḹḻḽ",
+	'm': "ḿṁṃ",
+	'n': "ñńņňǹṅṇṉṋ",
+	'o': "òóôõöōŏőơǒǫǭȍȏȫȭȯȱṍṏṑṓọỏốồổỗộớờởỡợ",
+	'p': "ṕṗ",
+	'r': "ŕŗřȑȓṙṛṝṟ",
+	's': "śŝşšșṡṣṥṧṩ",
+	't': "ţťțṫṭṯṱẗ",
+	'u': "ùúûüũūŭůűųưǔǖǘǚǜȕȗṳṵṷṹṻụủứừửữự",
+	'v': "ṽṿ",
+	'w': "ŵẁẃẅẇẉẘ",
+	'x': "ẋẍ",
+	'y': "ýÿŷȳẏẙỳỵỷỹ",
+	'z': "źżžẑẓẕ",
+	'æ': "ǣǽ",
+	'ø': "ǿ",
+	'ſ': "ẛ",
+	'ʒ': "ǯ",
+	'α': "άἀἁἂἃἄἅἆἇὰάᾀᾁᾂᾃᾄᾅᾆᾇᾰᾱᾲᾳᾴᾶᾷ",
+	'ε': "έἐἑἒἓἔἕὲέ",
+	'η': "ήἠἡἢἣἤἥἦἧὴήᾐᾑᾒᾓᾔᾕᾖᾗῂῃῄῆῇ",
+	'ι': "ΐίϊἰἱἲἳἴἵἶἷὶίῐῑῒΐῖῗ",
+	'ο': "όὀὁὂὃὄὅὸό",
+	'ρ': "ῤῥ",
+	'υ': "ΰϋύὐὑὒὓὔὕὖὗὺύῠῡῢΰῦῧ",
+	'ω': "ώὠὡὢὣὤὥὦὧὼώᾠᾡᾢᾣᾤᾥᾦᾧῲῳῴῶῷ",
+	'а': "ӑӓ",
+	'г': "ѓ",
+	'е': "ѐёӗ",
+	'ж': "ӂӝ",
+	'з': "ӟ",
+	'и': "йѝӣӥ",
+	'к': "ќ",
+	'о': "ӧ",
+	'у': "ўӯӱӳ",
+	'ч': "ӵ",
+	'ы': "ӹ",
+	'э': "ӭ",
+	'і': "ї",
+	'ѵ': "ѷ",
+	'ә': "ӛ",
+	'ө': "ӫ",
+}
+
+// bases maps the letters of decompositions to their base letter.
+var bases = func() map[rune]rune {
+	m := make(map[rune]rune)
+	for b, s := range decompositions {
+		for _, r := range s {
+			m[r] = b
+		}
+	}
+	return m
+}()
+
+// foldings holds the Latin letters which do not decompose into a base
+// letter and diacritics.
+var foldings = map[rune]rune{
+	'ø': 'o', 'ł': 'l', 'đ': 'd', 'ð': 'd', 'ħ': 'h', 'ı': 'i',
+	'ß': 's', 'æ': 'a', 'œ': 'o', 'þ': 't', 'ŋ': 'n', 'ŧ': 't',
+}
+
+// translit maps Greek and Cyrillic lowercase letters, without
+// diacritics, to the initial of their usual Latin transliteration.
+var translit = map[rune]rune{
+	// Greek
+	'α': 'a', 'β': 'v', 'γ': 'g', 'δ': 'd', 'ε': 'e', 'ζ': 'z',
+	'η': 'i', 'θ': 't', 'ι': 'i', 'κ': 'k', 'λ': 'l', 'μ': 'm',
+	'ν': 'n', 'ξ': 'x', 'ο': 'o', 'π': 'p', 'ρ': 'r', 'σ': 's',
+	'ς': 's', 'τ': 't', 'υ': 'y', 'φ': 'f', 'χ': 'c', 'ψ': 'p',
+	'ω': 'o',
+	// Cyrillic
+	'а': 'a', 'б': 'b', 'в': 'v', 'г': 'g', 'д': 'd', 'е': 'e',
+	'ж': 'z', 'з': 'z', 'и': 'i', 'к': 'k', 'л': 'l', 'м': 'm',
+	'н': 'n', 'о': 'o', 'п': 'p', 'р': 'r', 'с': 's', 'т': 't',
+	'у': 'u', 'ф': 'f', 'х': 'k', 'ц': 't', 'ч': 'c', 'ш': 's',
+	'щ': 's', 'ы': 'y', 'э': 'e', 'ю': 'y', 'я': 'y', 'і': 'i',
+	'є': 'y', 'ґ': 'g', 'ђ': 'd', 'ј': 'j', 'љ': 'l', 'њ': 'n',
+	'ћ': 'c', 'џ': 'd', 'ў': 'u',
+}
+
+// script returns the lowercase name of the script of r, unless it is
+// Latin, Common or Inherited.
+func script(r rune) string {
+	for name, table := range unicode.Scripts {
+		switch name {
+		case "Latin", "Common", "Inherited":
+			continue
+		}
+		if unicode.Is(table, r) {
+			return strings.ToLower(name)
+		}
+	}
+	return ""
+}
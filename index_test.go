@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+
+	"testing"
+)
+
+func TestIndexName(t *testing.T) {
+	defer func(m string) { *idxmode = m }(*idxmode)
+	tests := []struct {
+		mode, name, index, out string
+	}{
+		{"fold", "Queen", "Q", "q"},
+		{"fold", "Édith Piaf", "#", "e"},
+		{"fold", "Ólafur Arnalds", "O", "o"},
+		{"fold", "Øystein Sevåg", "#", "o"},
+		{"fold", "Ágætis", "#", "a"},
+		{"fold", "Ǽrø", "#", "a"},
+		{"fold", "Đặng Thái Sơn", "#", "d"},
+		{"fold", "Ἀφροδίτη", "#", "a"},
+		{"fold", "Кино", "#", "k"},
+		{"fold", "Ёлка", "#", "e"},
+		{"fold", "Ξυλούρης", "#", "x"},
+		{"fold", "坂本龍一", "#", otherIndex},
+		{"fold", "2Pac", "#", otherIndex},
+		{"fold", "'Til Tuesday", "T", otherIndex},
+		{"fold", "", "", otherIndex},
+		{"script", "Édith Piaf", "#", "e"},
+		{"script", "Кино", "#", "cyrillic"},
+		{"script", "Ξυλούρης", "#", "greek"},
+		{"script", "坂本龍一", "#", "han"},
+		{"script", "きゃりーぱみゅぱみゅ", "#", "hiragana"},
+		{"script", "2Pac", "#", otherIndex},
+		{"server", "Édith Piaf", "E", "e"},
+		{"server", "2Pac", "#", otherIndex},
+		{"server", "Nobody", "", otherIndex},
+		{"server", "Кино", "К", "к"},
+		{"server", "X/Y", "X-Z", "x-z"},
+	}
+	for _, tt := range tests {
+		*idxmode = tt.mode
+		a := subsonic.Artist{Resource: subsonic.Resource{Id: "1", Name: tt.name}, Index: tt.index}
+		if out := indexName(a); out != tt.out {
+			t.Error(tt.mode, tt.name, ":", out, "≠", tt.out)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"code.google.com/p/go9p/p/srv"
+
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minRetry = time.Second     // delay before reloading a listing after a failure
+	maxRetry = 5 * time.Minute // maximum delay, after repeated failures
+)
+
+// kid is a file of a directory mirroring an object of the server.
+type kid struct {
+	id string
+	f  *srv.File
+}
+
+// dirents tracks the files of a directory mirroring objects of the
+// server, so that they can be updated in place.
+type dirents struct {
+	mu   sync.Mutex
+	kids map[string]kid // by name
+}
+
+// addErrors are the failures to add some files to a directory.
+type addErrors []error
+
+func (e addErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// err returns e, or nil if empty.
+func (e addErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// update makes the files of dir match want. The files of the objects
+// still listed under the same name are kept, so that the fids on them
+// stay valid, the others are removed and the new ones are created by
+// add. The version of dir is bumped if anything changed. It returns the
+// files that could not be added.
+func (d *dirents) update(dir *srv.File, want []entry, add func(e entry) (*srv.File, error)) (errs addErrors) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.kids == nil {
+		d.kids = make(map[string]kid)
+	}
+	listed := make(map[string]bool)
+	changed := false
+	for _, e := range want {
+		listed[e.name] = true
+		if k, ok := d.kids[e.name]; ok {
+			if k.id == e.id {
+				continue
+			}
+			k.f.Remove()
+			delete(d.kids, e.name)
+			changed = true
+		}
+		f, err := add(e)
+		if err != nil {
+			log.Printf("could not add `%s': %s\n", e.name, err)
+			errs = append(errs, fmt.Errorf("could not add `%s': %s", e.name, err))
+			continue
+		}
+		d.kids[e.name] = kid{id: e.id, f: f}
+		changed = true
+	}
+	for name, k := range d.kids {
+		if !listed[name] {
+			k.f.Remove()
+			delete(d.kids, name)
+			changed = true
+		}
+	}
+	if changed {
+		dir.Lock()
+		dir.Qid.Version++
+		dir.Unlock()
+	}
+	return
+}
+
+// find returns the file named name, if it mirrors the object id.
+func (d *dirents) find(name, id string) *srv.File {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if k, ok := d.kids[name]; ok && k.id == id {
+		return k.f
+	}
+	return nil
+}
+
+// files returns the files of the directory.
+func (d *dirents) files() []*srv.File {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := make([]*srv.File, 0, len(d.kids))
+	for _, k := range d.kids {
+		files = append(files, k.f)
+	}
+	return files
+}
+
+// invalidate marks the listings below the directory as expired.
+func (d *dirents) invalidate() {
+	for _, f := range d.files() {
+		if i, ok := f.Ops.(interface{ invalidate() }); ok {
+			i.invalidate()
+		}
+	}
+}
+
+// listing is a directory whose files are loaded from the server, and
+// reloaded once older than -ttl.
+type listing struct {
+	loading sync.Mutex // held while loading
+	loaded  time.Time  // zero if not loaded yet, or expired
+	fails   int        // consecutive failed loads
+	retry   time.Time  // earliest reload after a failure
+	err     error      // last failure
+	dirents
+}
+
+// reload calls load unless the files are fresh. A failed load is
+// retried with exponential backoff, its error being returned until
+// then. Files that could not be added are reported, but not retried,
+// as the outcome would be the same.
+func (l *listing) reload(ctx context.Context, load func(ctx context.Context) error) error {
+	l.loading.Lock()
+	defer l.loading.Unlock()
+	if l.fresh() {
+		return nil
+	}
+	if time.Now().Before(l.retry) {
+		return l.err
+	}
+	err := load(ctx)
+	if _, partial := err.(addErrors); err == nil || partial {
+		l.loaded, l.fails, l.retry, l.err = time.Now(), 0, time.Time{}, nil
+		return err
+	}
+	log.Println(err)
+	if ctx.Err() == context.Canceled {
+		return err // aborted by the client, not failed
+	}
+	d := minRetry << uint(l.fails)
+	if d > maxRetry || d <= 0 {
+		d = maxRetry
+	}
+	l.fails++
+	l.retry, l.err = time.Now().Add(d), err
+	return err
+}
+
+// fresh reports whether the files are loaded and not expired. The
+// loading lock must be held.
+func (l *listing) fresh() bool {
+	return !l.loaded.IsZero() && (*ttl == 0 || time.Since(l.loaded) < *ttl)
+}
+
+// expire marks the listing as expired, leaving the ones below it alone.
+func (l *listing) expire() {
+	l.loading.Lock()
+	l.loaded = time.Time{}
+	l.loading.Unlock()
+}
+
+// invalidate marks the listing, and the ones below it, as expired. A
+// pending retry after a failure happens at once.
+func (l *listing) invalidate() {
+	l.loading.Lock()
+	l.loaded, l.retry = time.Time{}, time.Time{}
+	l.loading.Unlock()
+	l.dirents.invalidate()
+}
+
+// loader is a directory loaded from the server.
+type loader interface {
+	load(ctx context.Context) error
+	invalidate()
+}
+
+// refresh reloads the nearest directory loaded from the server at or
+// above f, expiring the listings below it.
+func refresh(ctx context.Context, f *srv.File) error {
+	for ; f != nil; f = f.Parent {
+		if l, ok := f.Ops.(loader); ok {
+			l.invalidate()
+			return l.load(ctx)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"code.google.com/p/go9p/p/srv"
+
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	dir := &srv.File{}
+	var d dirents
+	add := func(e entry) (*srv.File, error) {
+		f := &srv.File{}
+		if err := f.Add(dir, e.name, owner, nil, 0444, nil); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if err := d.update(dir, []entry{{name: "a", id: "1"}, {name: "b", id: "2"}}, add); err != nil {
+		t.Fatal(err)
+	}
+	if dir.Qid.Version != 1 {
+		t.Error(dir.Qid.Version, "≠", 1)
+	}
+	a := dir.Find("a")
+	d.update(dir, []entry{{name: "a", id: "1"}, {name: "b", id: "2"}}, add)
+	if dir.Qid.Version != 1 {
+		t.Error("version bumped with no change")
+	}
+	d.update(dir, []entry{{name: "a", id: "1"}, {name: "b", id: "3"}, {name: "c", id: "4"}}, add)
+	if dir.Qid.Version != 2 {
+		t.Error(dir.Qid.Version, "≠", 2)
+	}
+	if dir.Find("a") != a {
+		t.Error("kept file replaced")
+	}
+	if d.find("b", "2") != nil || d.find("b", "3") == nil || dir.Find("c") == nil {
+		t.Error("files not updated")
+	}
+	d.update(dir, []entry{{name: "c", id: "4"}}, add)
+	if dir.Find("a") != nil || dir.Find("b") != nil || dir.Find("c") == nil {
+		t.Error("files not removed")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var mu sync.Mutex
+	songs, calls := []string{"1", "2"}, 0
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		var list []string
+		for _, id := range songs {
+			list = append(list, fmt.Sprintf(`{"id":%q,"title":"t%s","track":%s,"suffix":"mp3"}`, id, id, id))
+		}
+		fmt.Fprintf(w, `{"subsonic-response":{"status":"ok","version":"1.8.0","album":{"song":[%s]}}}`,
+			strings.Join(list, ","))
+	})
+	if err := parseTemplates(); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	root := &srv.File{}
+	root.Add(nil, "/", owner, nil, dirperm, nil)
+	d := &AlbumDir{id: "x"}
+	d.Add(root, "album", owner, nil, dirperm, d)
+
+	ctx := context.Background()
+	if err := d.load(ctx); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	first := d.Find("01_t1.mp3")
+	if first == nil || d.Find("02_t2.mp3") == nil {
+		t.Fatal("songs not loaded")
+	}
+	d.load(ctx)
+	if calls != 1 {
+		t.Error("fresh listing reloaded")
+	}
+
+	mu.Lock()
+	songs = []string{"1", "3"}
+	mu.Unlock()
+	v := d.Qid.Version
+	if err := refresh(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Error("listing not reloaded")
+	}
+	if d.Find("01_t1.mp3") != first {
+		t.Error("kept song replaced")
+	}
+	if d.Find("02_t2.mp3") != nil || d.Find("03_t3.mp3") == nil {
+		t.Error("songs not updated")
+	}
+	if d.Qid.Version == v {
+		t.Error("version not bumped")
+	}
+	if next := d.next(first.Ops.(*SongFile), 2); len(next) != 1 || next[0].id != "3" {
+		t.Error("album order not updated:", next)
+	}
+}
+
+func TestReloadBackoff(t *testing.T) {
+	var l listing
+	calls := 0
+	fail := func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("boom")
+	}
+	ctx := context.Background()
+	if err := l.reload(ctx, fail); err == nil {
+		t.Fatal("failure not reported")
+	}
+	if err := l.reload(ctx, fail); err == nil || calls != 1 {
+		t.Error("failed load retried before the backoff:", err, calls)
+	}
+	if d := time.Until(l.retry); d <= 0 || d > minRetry {
+		t.Error("retry in", d)
+	}
+	l.retry = time.Now()
+	l.reload(ctx, fail)
+	if d := time.Until(l.retry); calls != 2 || d <= minRetry || d > 2*minRetry {
+		t.Error("backoff not doubled:", calls, d)
+	}
+
+	l.invalidate()
+	partial := func(ctx context.Context) error {
+		calls++
+		return addErrors{fmt.Errorf("could not add `a'"), fmt.Errorf("could not add `b'")}
+	}
+	err := l.reload(ctx, partial)
+	if err == nil || err.Error() != "could not add `a'; could not add `b'" {
+		t.Error("partial failure:", err)
+	}
+	if l.reload(ctx, fail) != nil || calls != 3 {
+		t.Error("partially loaded listing reloaded")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	l.invalidate()
+	l.reload(ctx, fail)
+	if !l.retry.IsZero() {
+		t.Error("cancelled load counted as failure")
+	}
+}
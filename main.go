@@ -5,30 +5,236 @@ import (
 	"code.google.com/p/go9p/p"
 	"code.google.com/p/go9p/p/srv"
 
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	maxbps = flag.Int("b", 192, "max bps")
+	apikey = flag.String("a", "", "OpenSubsonic API key (instead of -u and -p)")
+	maxbps = flag.Int("b", 192, "max bitrate in kbps (0 for no limit)")
 	addr   = flag.String("l", ":5640", "listening network address")
 	host   = flag.String("h", "", "subsonic server (e.g.: ss.example.com:1234)")
 	tls    = flag.Bool("s", false, "enable http secure")
+	cafile = flag.String("ca", "", "additional CA certificates (PEM) to verify the server")
+	pin    = flag.String("pin", "", "SHA-256 fingerprint of the server public key")
+	insec  = flag.Bool("insecure", false, "do not verify the server certificate chain")
 	passwd = flag.String("p", "", "subsonic password")
 	user   = flag.String("u", "", "subsonic username")
+	tmout  = flag.Duration("t", 30*time.Second, "timeout of subsonic requests (0 for none)")
+	ttl    = flag.Duration("ttl", time.Hour, "time after which directory listings are reloaded (0 for never)")
+	poll   = flag.Duration("watch", 5*time.Minute, "interval of the checks for changes of the library (0 to disable)")
+	format = flag.String("f", "auto", "response format: json, xml or auto")
+	disc   = flag.String("disc", "prefix", "layout of multi-disc albums: prefix (1-01_title), dir (disc1/01_title) or none")
+	config = flag.String("config", "", "file with `flag=value' lines, overridden by the command line")
+
+	artistfmt = flag.String("artistfmt", "{name}", "template of artist directory names")
+	albumfmt  = flag.String("albumfmt", "{name}", "template of album directory names")
+	songfmt   = flag.String("songfmt", "{track:02}_{title}.{suffix}", "template of song file names")
+	artistsan = flag.String("artistsan", "legacy", "sanitizer of artist names: legacy, posix or unicode")
+	albumsan  = flag.String("albumsan", "legacy", "sanitizer of album names: legacy, posix or unicode")
+	songsan   = flag.String("songsan", "legacy", "sanitizer of song names: legacy, posix or unicode")
+	idxmode   = flag.String("index", "fold", "artist index directories: fold, script or server")
+
+	cachedir  = flag.String("cache", "", "directory caching the songs (empty to disable)")
+	cachesize = flag.Int64("cachesize", 1024, "maximum size of the song cache, in MB")
+	prefetch  = flag.Int("prefetch", 1, "number of following album songs downloaded into the cache while reading one")
+	prefetbw  = flag.Int("prefetchbw", 0, "bandwidth of each prefetch download, in KB/s (0 for unlimited)")
+
+	retries   = flag.Int("retries", 2, "retries of subsonic requests failing with a transient error")
+	retrywait = flag.Duration("retrywait", time.Second, "delay before the first retry, doubled at each next one")
+	retrymax  = flag.Duration("retrymax", 30*time.Second, "maximum delay between retries")
+
+	maxcalls   = flag.Int("maxcalls", 4, "maximum concurrent subsonic requests (0 for unlimited)")
+	rate       = flag.Float64("rate", 0, "maximum subsonic requests per second (0 for unlimited)")
+	burst      = flag.Int("burst", 5, "subsonic requests allowed at once above -rate")
+	maxstreams = flag.Int("maxstreams", 0, "maximum concurrent song transfers, prefetches included, which never take the last one (0 for unlimited)")
 
 	client  *subsonic.Client
+	cache   *songCache // nil if disabled
 	streams = struct {
+		sync.Mutex // guards m only, each stream has its own lock
+		m          map[*srv.Fid]*stream
+	}{m: make(map[*srv.Fid]*stream)}
+
+	// inflight holds the cancel functions of the requests in progress
+	// on each fid, so that a Tflush or a clunk can abort them.
+	inflight = struct {
 		sync.Mutex
-		m map[*srv.Fid]io.ReadCloser
-	}{m: make(map[*srv.Fid]io.ReadCloser)}
+		n int
+		m map[*srv.Fid]map[int]context.CancelFunc
+	}{m: make(map[*srv.Fid]map[int]context.CancelFunc)}
 )
 
+// stream is the state of the song being read on a fid, kept until the
+// fid is destroyed: either a cached copy or a transfer, which is saved to
+// the cache if read from start to end.
+type stream struct {
+	sync.Mutex                  // held while reading
+	io.ReadCloser               // nil once closed
+	r             *bufio.Reader // buffers the transfer
+	done          func()        // releases the context of the transfer
+	off           uint64        // offset of the next byte
+	eof           bool          // off is the size of the song
+	cw            *cacheWriter  // copy of the transfer, if any
+	file          *os.File      // cached song, if any
+	part          *partial      // song being prefetched, if any
+	opened        bool          // the cache was looked up
+	clunked       bool          // the fid was clunked, not destroyed yet
+}
+
+// bufsize is the size of the buffer of each transfer.
+const bufsize = 64 << 10
+
+// Close closes the transfer, discarding its partial copy.
+func (s *stream) Close() error {
+	if s.cw != nil {
+		s.cw.abort()
+		s.cw = nil
+	}
+	if s.ReadCloser == nil {
+		return nil
+	}
+	defer s.done()
+	err := s.ReadCloser.Close()
+	s.ReadCloser = nil
+	return err
+}
+
+// release closes the stream and the cached song.
+func (s *stream) release() {
+	s.Close()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if s.part != nil {
+		s.part.Close()
+		s.part = nil
+	}
+}
+
+// open opens a transfer of song starting at offset, copied to the cache
+// if starting from the beginning. It returns the size of the song
+// reported by the server, or -1.
+func (s *stream) open(fid *srv.Fid, song string, offset uint64) (int64, error) {
+	s.Close()
+	ctx, done := fidContext(fid, 0)
+	t, err := transfer(ctx, song, offset)
+	if err != nil {
+		done()
+		return 0, err
+	}
+	s.ReadCloser, s.done, s.off, s.eof = t, done, offset, false
+	if s.r == nil {
+		s.r = bufio.NewReaderSize(t, bufsize)
+	} else {
+		s.r.Reset(t)
+	}
+	if offset == 0 && cache != nil {
+		if s.cw, err = cache.create(songKey(song)); err != nil {
+			log.Printf("could not cache song %s: %s\n", song, err)
+		}
+	}
+	return t.Size, nil
+}
+
+// transfer opens a transfer of song starting at offset. Streaming does
+// not need the download role, even when the bitrate is not limited.
+func transfer(ctx context.Context, song string, offset uint64) (*subsonic.Transfer, error) {
+	return client.StreamAtContext(ctx, song, *maxbps, int64(offset))
+}
+
+// songKey returns the cache key of song, as transferred according to
+// the flags.
+func songKey(song string) string {
+	return cacheKey(song, "stream", *maxbps)
+}
+
+// reqContext returns a context for a request to the server, expiring
+// after the timeout set by -t, if any.
+func reqContext() (context.Context, context.CancelFunc) {
+	if *tmout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), *tmout)
+}
+
+// fidContext returns a context for a request on fid. The context
+// expires after d, if not zero, and is cancelled by cancelFid. The
+// returned function must be called once the request is done.
+func fidContext(fid *srv.Fid, d time.Duration) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if d > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), d)
+	}
+	inflight.Lock()
+	defer inflight.Unlock()
+	id := inflight.n
+	inflight.n++
+	if inflight.m[fid] == nil {
+		inflight.m[fid] = make(map[int]context.CancelFunc)
+	}
+	inflight.m[fid][id] = cancel
+	return ctx, func() {
+		cancel()
+		inflight.Lock()
+		defer inflight.Unlock()
+		delete(inflight.m[fid], id)
+		if len(inflight.m[fid]) == 0 {
+			delete(inflight.m, fid)
+		}
+	}
+}
+
+// cancelFid cancels the requests in progress on fid.
+func cancelFid(fid *srv.Fid) {
+	inflight.Lock()
+	defer inflight.Unlock()
+	for _, cancel := range inflight.m[fid] {
+		cancel()
+	}
+}
+
+// fsError returns err as a 9P error: missing objects and denied
+// operations are told apart, the rest is an I/O error.
+func fsError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, subsonic.ErrNotFound):
+		return &p.Error{Err: "file does not exist", Errornum: p.ENOENT}
+	case errors.Is(err, subsonic.ErrNotAuthorized),
+		errors.Is(err, subsonic.ErrWrongCredentials),
+		errors.Is(err, subsonic.ErrTokenUnsupported):
+		return &p.Error{Err: "permission denied", Errornum: p.EPERM}
+	}
+	if _, ok := err.(*p.Error); ok {
+		return err
+	}
+	return &p.Error{Err: err.Error(), Errornum: p.EIO}
+}
+
+// fsrv is the file server with support for flushing requests.
+type fsrv struct {
+	*srv.Fsrv
+}
+
+func (*fsrv) Flush(req *srv.Req) {
+	if req.Fid != nil {
+		cancelFid(req.Fid)
+	}
+}
+
 func init() {
 	log.SetFlags(0)
 	log.SetPrefix("subsonicfs: ")
@@ -36,186 +242,662 @@ func init() {
 
 func main() {
 	flag.Parse()
-	if *user == "" || *host == "" {
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := parseTemplates(); err != nil {
+		log.Fatalln(err)
+	}
+	if (*user == "" && *apikey == "") || *host == "" {
 		flag.Usage()
 		return
 	}
-	client = subsonic.NewClient(*host, *user, *passwd, *tls)
-	if err := client.Ping(); err != nil {
+	if *apikey != "" {
+		client = subsonic.NewAPIKeyClient(*host, *apikey, *tls)
+	} else {
+		client = subsonic.NewClient(*host, *user, *passwd, *tls)
+	}
+	switch *idxmode {
+	case "fold", "script", "server":
+	default:
+		log.Fatalf("unknown index mode `%s'\n", *idxmode)
+	}
+	switch *disc {
+	case "prefix", "dir", "none":
+	default:
+		log.Fatalf("unknown disc layout `%s'\n", *disc)
+	}
+	switch *format {
+	case "auto":
+	case "json":
+		client.SetFormat(subsonic.FormatJSON)
+	case "xml":
+		client.SetFormat(subsonic.FormatXML)
+	default:
+		log.Fatalf("unknown response format `%s'\n", *format)
+	}
+	client.SetRetryPolicy(subsonic.RetryPolicy{
+		Attempts: *retries + 1,
+		MinDelay: *retrywait,
+		MaxDelay: *retrymax,
+	})
+	client.SetLimits(subsonic.Limits{
+		Calls:   *maxcalls,
+		Rate:    *rate,
+		Burst:   *burst,
+		Streams: *maxstreams,
+	})
+	if !*tls && (*cafile != "" || *pin != "" || *insec) {
+		log.Fatalln("-ca, -pin and -insecure need -s")
+	}
+	if *tls {
+		tc, err := subsonic.TLSConfig(*cafile, *pin, *insec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		client.SetTLSConfig(tc)
+	}
+	ctx, cancel := reqContext()
+	err := client.PingContext(ctx)
+	cancel()
+	if err != nil {
 		log.Fatalln(err)
 		return
 	}
-	fs, err := buildFs()
+	if *cachedir != "" {
+		if cache, err = openCache(*cachedir, *cachesize<<20); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	start := time.Now() // changes later are seen by watch
+	ctx, cancel = reqContext()
+	fs, err := buildFs(ctx)
+	cancel()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	fs.Start(fs)
+	if *poll > 0 {
+		go watch(fs.Root.Ops.(*RootDir), start, *poll)
+	}
+	fs.Start(&fsrv{fs})
 	if err := fs.StartNetListener("tcp", *addr); err != nil {
 		log.Fatalln(err)
 	}
 }
 
+// loadConfig sets the flags listed in file, one `name=value' per line,
+// unless they were given on the command line. Empty lines and lines
+// starting with '#' are ignored.
+func loadConfig(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: expecting name=value", file, i+1)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", file, i+1, err)
+		}
+	}
+	return nil
+}
+
 var (
 	dirperm = uint32(p.DMDIR | 0555)
 	owner   = p.OsUsers.Uid2User(os.Getuid())
-	srepl   = strings.NewReplacer(
-		`"`, "_",
-		" ", "␣",
-		"/", "_", // mandatory
-		"'", "_",
-		"(", "_",
-		")", "_",
-		"#", "_",
-		"&", "and",
-	)
 )
 
-func tr(s string) string {
-	return srepl.Replace(strings.ToLower(s))
-}
-
-func buildFs() (*srv.Fsrv, error) {
-	root := &srv.File{}
-	if err := root.Add(nil, "/", owner, nil, dirperm, nil); err != nil {
+func buildFs(ctx context.Context) (*srv.Fsrv, error) {
+	root := &RootDir{}
+	if err := root.Add(nil, "/", owner, nil, dirperm, root); err != nil {
 		return nil, err
 	}
 	ctl := &Ctl{}
-	if err := ctl.Add(root, "ctl", owner, nil, 0664, ctl); err != nil {
+	if err := ctl.Add(&root.File, "ctl", owner, nil, 0664, ctl); err != nil {
 		return nil, err
 	}
+	if err := root.load(ctx); err != nil {
+		return nil, err
+	}
+	return srv.NewFileSrv(&root.File), nil
+}
+
+// GroupDir is a directory grouping the files of its parent, by index
+// letter or disc.
+type GroupDir struct {
+	srv.File
+	dirents
+}
+
+// addGroup returns a function adding the group named by the entry to dir.
+func addGroup(dir *srv.File) func(e entry) (*srv.File, error) {
+	return func(e entry) (*srv.File, error) {
+		g := &GroupDir{}
+		if err := g.Add(dir, e.name, owner, nil, dirperm, g); err != nil {
+			return nil, err
+		}
+		return &g.File, nil
+	}
+}
+
+type RootDir struct {
+	srv.File
+	listing
+	counts map[string]int // number of albums of the artists, by id
+}
 
-	artists, err := client.GetArtists()
+func (d *RootDir) Stat(fid *srv.FFid) error {
+	ctx, done := fidContext(fid.Fid, *tmout)
+	defer done()
+	return fsError(d.load(ctx))
+}
+
+// load loads the artists in their index directories, unless fresh.
+func (d *RootDir) load(ctx context.Context) error {
+	return d.reload(ctx, d.fetch)
+}
+
+func (d *RootDir) fetch(ctx context.Context) error {
+	artists, err := client.GetArtistsContext(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("could not load artists: %w", err)
 	}
+	indexes := make(map[string][]entry)
+	counts := make(map[string]int)
+	var letters []entry
 	for _, artist := range artists {
-		name := tr(artist.Name)
-		r := []rune(name)[0]
-		letter := string(r)
-		if r < 'a' || r > 'z' {
-			letter = "@" // subsonic uses '#', but I don't like it. 
-		}
-		index := root.Find(letter)
-		if index == nil {
-			index = &srv.File{}
-			if err := index.Add(root, letter, owner, nil, dirperm, nil); err != nil {
-				log.Printf("could not add index directory `%c': %s\n", index, err)
-				continue
-			}
+		counts[artist.Id] = artist.AlbumCount
+		name := artistName(artist)
+		letter := indexName(artist)
+		if indexes[letter] == nil {
+			letters = append(letters, entry{name: letter, id: letter})
 		}
-		dir := &ArtistDir{id: artist.Id}
-		if err := dir.Add(index, name, owner, nil, dirperm, dir); err != nil {
-			log.Printf("could not add artist directory `%s': %s\n", name, err)
+		indexes[letter] = append(indexes[letter], entry{name: name, id: artist.Id})
+	}
+	errs := d.update(&d.File, letters, addGroup(&d.File))
+	for letter, entries := range indexes {
+		f := d.find(letter, letter)
+		if f == nil {
 			continue
 		}
+		index := f.Ops.(*GroupDir)
+		uniq(entries, false)
+		errs = append(errs, index.update(f, entries, func(e entry) (*srv.File, error) {
+			dir := &ArtistDir{id: e.id}
+			if err := dir.Add(f, e.name, owner, nil, dirperm, dir); err != nil {
+				return nil, err
+			}
+			return &dir.File, nil
+		})...)
+		for _, e := range entries {
+			if n, ok := d.counts[e.id]; ok && n != counts[e.id] {
+				if f := index.find(e.name, e.id); f != nil {
+					f.Ops.(*ArtistDir).expire()
+				}
+			}
+		}
 	}
-	return srv.NewFileSrv(root), nil
+	d.counts = counts
+	return errs.err()
+}
+
+// changed reloads the artists after a change of the library. The
+// artists are expired too: the number of songs of their albums is only
+// known to them, and compared when they are next loaded, expiring the
+// albums which changed.
+func (d *RootDir) changed(ctx context.Context) error {
+	d.expire()
+	for _, index := range d.files() {
+		for _, f := range index.Ops.(*GroupDir).files() {
+			f.Ops.(*ArtistDir).expire()
+		}
+	}
+	return d.load(ctx)
 }
 
 type ArtistDir struct {
 	srv.File
-	sync.Once
-	id int
+	listing
+	id     string
+	counts map[string]int // number of songs of the albums, by id
 }
 
-func (d *ArtistDir) Stat(fid *srv.FFid) (e error) {
-	f := func() {
-		albums, err := client.GetArtist(d.id)
-		if err != nil {
-			log.Printf("could not load albums for artist %d: %s\n", d.id, err)
-			e = err
-		}
-		for _, album := range albums {
-			name := tr(album.Name)
-			subdir := &AlbumDir{id: album.Id}
-			if err := subdir.Add(&d.File, name, owner, nil, dirperm, subdir); err != nil {
-				log.Printf("could not add subdirectory `%s': %s\n", name, err)
-				continue
+func (d *ArtistDir) Stat(fid *srv.FFid) error {
+	ctx, done := fidContext(fid.Fid, *tmout)
+	defer done()
+	return fsError(d.load(ctx))
+}
+
+// load loads the albums of the artist, unless fresh.
+func (d *ArtistDir) load(ctx context.Context) error {
+	return d.reload(ctx, d.fetch)
+}
+
+func (d *ArtistDir) fetch(ctx context.Context) error {
+	albums, err := client.GetArtistContext(ctx, d.id)
+	if err != nil {
+		return fmt.Errorf("could not load albums for artist %s: %w", d.id, err)
+	}
+	entries := make([]entry, len(albums))
+	counts := make(map[string]int)
+	var mtime time.Time
+	for i, album := range albums {
+		counts[album.Id] = album.SongCount
+		entries[i] = entry{name: albumName(album), id: album.Id, mtime: album.Created}
+		if album.Created.After(mtime) {
+			mtime = album.Created
+		}
+	}
+	uniq(entries, false)
+	errs := d.update(&d.File, entries, func(e entry) (*srv.File, error) {
+		subdir := &AlbumDir{id: e.id}
+		if err := subdir.Add(&d.File, e.name, owner, nil, dirperm, subdir); err != nil {
+			return nil, err
+		}
+		setTimes(&subdir.File, e.mtime)
+		return &subdir.File, nil
+	})
+	for _, e := range entries {
+		if n, ok := d.counts[e.id]; ok && n != counts[e.id] {
+			if f := d.find(e.name, e.id); f != nil {
+				f.Ops.(*AlbumDir).expire()
 			}
 		}
 	}
-	d.Do(f) // just once
-	return
+	d.counts = counts
+	setTimes(&d.File, mtime)
+	return errs.err()
 }
 
 type AlbumDir struct {
 	srv.File
-	sync.Once
-	id int
+	listing
+	id string
+
+	mu    sync.Mutex
+	songs []*SongFile // in album order
 }
 
-func (d *AlbumDir) Stat(fid *srv.FFid) (e error) {
-	f := func() {
-		songs, err := client.GetAlbum(d.id)
-		if err != nil {
-			e = err
+// prev returns the song preceding f in the album, if any.
+func (d *AlbumDir) prev(f *SongFile) *SongFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, s := range d.songs {
+		if s == f && i > 0 {
+			return d.songs[i-1]
 		}
-		for _, s := range songs {
-			f := &SongFile{id: s.Id}
-			name := tr(fmt.Sprintf("%02d_%s.%s", s.Number, s.Name, s.Suffix))
-			if err := f.Add(&d.File, name, owner, nil, 0444, f); err != nil {
-				e = err
+	}
+	return nil
+}
+
+// next returns up to n songs following f in the album.
+func (d *AlbumDir) next(f *SongFile, n int) []*SongFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, s := range d.songs {
+		if s == f {
+			d := d.songs[i+1:]
+			if len(d) > n {
+				d = d[:n]
 			}
+			return d
 		}
 	}
-	d.Do(f) // just once
-	return
+	return nil
+}
+
+func (d *AlbumDir) Stat(fid *srv.FFid) error {
+	ctx, done := fidContext(fid.Fid, *tmout)
+	defer done()
+	return fsError(d.load(ctx))
+}
+
+// load loads the songs of the album, unless fresh.
+func (d *AlbumDir) load(ctx context.Context) error {
+	return d.reload(ctx, d.fetch)
+}
+
+func (d *AlbumDir) fetch(ctx context.Context) error {
+	songs, err := client.GetAlbumContext(ctx, d.id)
+	if err != nil {
+		return fmt.Errorf("could not load songs for album %s: %w", d.id, err)
+	}
+	// songs with no disc number (0) go to the lowest numbered disc
+	discs := make(map[int]bool)
+	low := 0
+	for _, s := range songs {
+		if n := s.DiscNumber; n > 0 {
+			discs[n] = true
+			if low == 0 || n < low {
+				low = n
+			}
+		}
+	}
+	for i := range songs {
+		if songs[i].DiscNumber == 0 {
+			songs[i].DiscNumber = low
+		}
+	}
+	multi := len(discs) > 1
+	bydir := multi && *disc == "dir"
+	dirs := make(map[int][]entry) // by disc, in dir layout
+	if !bydir {
+		dirs[0] = nil // removes the songs if none is left
+	}
+	var subdirs []entry
+	var errs addErrors
+	var mtime time.Time
+	for _, s := range songs {
+		if s.Created.After(mtime) {
+			mtime = s.Created
+		}
+		t, n := songTmpl, 0
+		switch {
+		case multi && *disc == "prefix":
+			t = multiTmpl
+		case bydir:
+			n = s.DiscNumber
+			if dirs[n] == nil {
+				name := fmt.Sprintf("disc%d", n)
+				subdirs = append(subdirs, entry{name: name, id: name})
+			}
+		}
+		dirs[n] = append(dirs[n], entry{
+			name:   songName(t, s),
+			id:     s.Id,
+			mtime:  s.Created,
+			length: songLength(s),
+		})
+	}
+	if bydir {
+		errs = d.update(&d.File, subdirs, addGroup(&d.File))
+	}
+	files := make(map[string]*SongFile)
+	for n, entries := range dirs {
+		dir, ents := &d.File, &d.dirents
+		if bydir {
+			name := fmt.Sprintf("disc%d", n)
+			if dir = d.find(name, name); dir == nil {
+				continue
+			}
+			setTimes(dir, mtime)
+			ents = &dir.Ops.(*GroupDir).dirents
+		}
+		uniq(entries, true)
+		errs = append(errs, ents.update(dir, entries, func(s entry) (*srv.File, error) {
+			f := &SongFile{id: s.id, album: d}
+			if err := f.Add(dir, s.name, owner, nil, 0444, f); err != nil {
+				return nil, err
+			}
+			f.setLength(s.length)
+			setTimes(&f.File, s.mtime)
+			return &f.File, nil
+		})...)
+		for _, s := range entries {
+			if f := ents.find(s.name, s.id); f != nil {
+				files[s.id] = f.Ops.(*SongFile)
+			}
+		}
+	}
+	var list []*SongFile
+	for _, s := range songs {
+		if f, ok := files[s.Id]; ok {
+			list = append(list, f)
+		}
+	}
+	d.mu.Lock()
+	d.songs = list
+	d.mu.Unlock()
+	return errs.err()
 }
 
 type SongFile struct {
 	srv.File
-	id int
+	id    string
+	album *AlbumDir
 }
 
-func (f *SongFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+// songLength returns the size of s as read from the file system: the
+// size of the original file, or an estimate if it will be transcoded.
+// The estimate is corrected once the actual size is known: told by the
+// server, or found at the end of the transfer.
+func songLength(s subsonic.Song) uint64 {
+	if *maxbps == 0 || (s.BitRate > 0 && s.BitRate <= *maxbps) {
+		return uint64(s.Size)
+	}
+	return uint64(s.Duration.Seconds() * float64(*maxbps) * 1000 / 8)
+}
+
+func (f *SongFile) setLength(n uint64) {
+	f.Lock()
+	f.Length = n
+	f.Unlock()
+}
+
+// setTimes sets the access and modification times of f to t, unless it
+// is zero.
+func setTimes(f *srv.File, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	f.Lock()
+	f.Atime = uint32(t.Unix())
+	f.Mtime = f.Atime
+	f.Unlock()
+}
+
+// lockStream returns the stream of fid, locked, opening it on the first
+// read. The song is looked up in the cache, or among the prefetches in
+// progress. The global lock is never held while waiting for the stream.
+func (f *SongFile) lockStream(fid *srv.Fid) (*stream, error) {
 	streams.Lock()
-	defer streams.Unlock()
-	src, ok := streams.m[fid.Fid]
+	src, ok := streams.m[fid]
 	if !ok {
-		if offset > 0 {
+		src = &stream{}
+		streams.m[fid] = src
+	}
+	streams.Unlock()
+	src.Lock()
+	if src.clunked {
+		src.Unlock()
+		return nil, &p.Error{Err: "fid clunked", Errornum: p.EIO}
+	}
+	if !src.opened && cache != nil {
+		readAhead(f, fid)
+		key := songKey(f.id)
+		if file, err := cache.open(key); err == nil {
+			src.file = file
+			if fi, err := file.Stat(); err == nil {
+				f.setLength(uint64(fi.Size()))
+			}
+		} else {
+			src.part = prefetched(key) // read as it is downloaded
+		}
+	}
+	src.opened = true
+	return src, nil
+}
+
+// Read reads the song at any offset, from the cache if possible.
+// Otherwise, the transfer is reopened from the requested offset
+// whenever it is not the current one. Only the stream of fid is locked
+// meanwhile, so that a slow transfer does not block the other ones.
+func (f *SongFile) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
+	src, err := f.lockStream(fid.Fid)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Unlock()
+	if src.file != nil {
+		c, err := src.file.ReadAt(buf, int64(offset))
+		if err == io.EOF {
+			src.eof = true
+			endReadAhead(f, fid.Fid)
+			err = nil
+		}
+		return c, err
+	}
+	if src.part != nil {
+		ctx, done := fidContext(fid.Fid, 0)
+		c, err := src.part.readAt(ctx, buf, int64(offset))
+		done()
+		switch err {
+		case nil:
+			return c, nil
+		case io.EOF:
+			src.eof = true
+			f.setLength(offset)
+			endReadAhead(f, fid.Fid)
 			return 0, nil
+		case errPrefetch:
+			src.part.Close()
+			src.part = nil // transferred instead
+		default:
+			return 0, fsError(err)
 		}
-		r, err := client.Stream(f.id, *maxbps)
+	}
+	if src.eof && offset >= src.off {
+		return 0, nil
+	}
+	if src.ReadCloser == nil || src.off != offset {
+		size, err := src.open(fid.Fid, f.id, offset)
 		if err != nil {
-			return 0, err
+			log.Printf("could not open song %s: %s\n", f.id, err)
+			return 0, fsError(err)
+		}
+		if size > 0 {
+			f.setLength(uint64(size))
+		}
+	}
+	c, err := src.r.Read(buf)
+	if c > 0 && src.cw != nil {
+		if _, err := src.cw.Write(buf[:c]); err != nil {
+			log.Printf("could not cache song %s: %s\n", f.id, err)
+			src.cw.abort()
+			src.cw = nil
 		}
-		streams.m[fid.Fid] = r
-		src = r
 	}
-	c, err := src.Read(buf)
+	src.off += uint64(c)
 	if err != nil {
-		src.Close()
-		delete(streams.m, fid.Fid)
 		if err == io.EOF {
-			return 0, nil
+			if src.cw != nil {
+				if err := src.cw.commit(); err != nil {
+					log.Printf("could not cache song %s: %s\n", f.id, err)
+				}
+				src.cw = nil
+			}
+			src.Close()
+			src.eof = true
+			f.setLength(src.off)
+			endReadAhead(f, fid.Fid)
+			return c, nil
 		}
-		return c, err
+		src.Close() // reopened by the next read
+		return c, fsError(err)
 	}
 	return c, nil
 }
 
+// Clunk closes the stream of fid, leaving it in streams, marked as
+// clunked, until the fid is destroyed: a Read still in progress cannot
+// reopen it.
 func (f *SongFile) Clunk(fid *srv.FFid) error {
+	cancelFid(fid.Fid) // don't wait for a blocked Read
 	streams.Lock()
-	defer streams.Unlock()
-	if src, ok := streams.m[fid.Fid]; ok {
-		src.Close()
-		delete(streams.m, fid.Fid)
+	src, ok := streams.m[fid.Fid]
+	if !ok {
+		src = &stream{}
+		streams.m[fid.Fid] = src
+	}
+	streams.Unlock()
+	src.Lock()
+	src.clunked = true
+	src.release()
+	eof := src.eof
+	src.Unlock()
+	if !eof {
+		// stopped before the end: the next songs are not wanted
+		stopReadAhead(f, fid.Fid)
 	}
 	return nil
 }
 
+func (f *SongFile) FidDestroy(fid *srv.FFid) {
+	streams.Lock()
+	delete(streams.m, fid.Fid)
+	streams.Unlock()
+}
+
 type Ctl struct {
 	srv.File
 }
 
+// lookup returns the file at path, relative to the root of the file
+// system holding ctl.
+func (ctl *Ctl) lookup(path string) (*srv.File, error) {
+	f := &ctl.File
+	for f.Parent != nil {
+		f = f.Parent
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if f = f.Find(name); f == nil {
+			return nil, srv.Enoent
+		}
+	}
+	return f, nil
+}
+
 func (*Ctl) Read(fid *srv.FFid, buf []byte, offset uint64) (int, error) {
 	return 0, nil
 }
 
-func (*Ctl) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
-	switch s := string(data); s {
+// Write executes the commands:
+//
+//	close		terminates subsonicfs
+//	refresh [path]	reloads the directory at path (default /) and
+//			expires the listings below it
+func (ctl *Ctl) Write(fid *srv.FFid, data []byte, offset uint64) (int, error) {
+	args := strings.Fields(string(data))
+	if len(args) == 0 {
+		return len(data), nil
+	}
+	switch args[0] {
 	case "close":
 		defer os.Exit(0)
+	case "refresh":
+		path := "/"
+		if len(args) > 1 {
+			path = args[1]
+		}
+		f, err := ctl.lookup(path)
+		if err != nil {
+			return 0, err
+		}
+		ctx, done := fidContext(fid.Fid, *tmout)
+		defer done()
+		if err := refresh(ctx, f); err != nil {
+			return 0, fsError(err)
+		}
 	}
 	return len(data), nil
 }
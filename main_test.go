@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+	"code.google.com/p/go9p/p"
+	"code.google.com/p/go9p/p/srv"
+
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelReads(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	drop := make(chan struct{})
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "drop" {
+			w.Write([]byte("so"))
+			w.(http.Flusher).Flush()
+			<-drop
+			panic(http.ErrAbortHandler) // connection lost mid-transfer
+		}
+		if id == "slow" {
+			w.Write([]byte("so"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("song " + id))
+	})
+
+	slow := &srv.FFid{Fid: &srv.Fid{}}
+	sf := &SongFile{id: "slow"}
+	buf := make([]byte, 64)
+	if n, err := sf.Read(slow, buf, 0); err != nil || string(buf[:n]) != "so" {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", string(buf[:n]), err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := sf.Read(slow, make([]byte, 64), 2) // waits for the server
+		blocked <- err
+	}()
+
+	// two reads of the same fid, the first one failing:
+	dropped := &srv.FFid{Fid: &srv.Fid{}}
+	df := &SongFile{id: "drop"}
+	if n, err := df.Read(dropped, buf, 0); err != nil || string(buf[:n]) != "so" {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", string(buf[:n]), err)
+	}
+	failed := make(chan error, 2)
+	for i := 0; i < cap(failed); i++ {
+		go func() {
+			_, err := df.Read(dropped, make([]byte, 64), 2)
+			failed <- err
+		}()
+	}
+	streams.Lock()
+	src := streams.m[dropped.Fid]
+	streams.Unlock()
+	for src.TryLock() { // until a read is in progress
+		src.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // the other one waits for it
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f := &SongFile{id: fmt.Sprint(i)}
+			fid := &srv.FFid{Fid: &srv.Fid{}}
+			defer clunk(f, fid)
+			var got []byte
+			buf := make([]byte, 3)
+			for {
+				n, err := f.Read(fid, buf, uint64(len(got)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if n == 0 {
+					break
+				}
+				got = append(got, buf[:n]...)
+			}
+			if want := fmt.Sprint("song ", i); string(got) != want {
+				errs <- fmt.Errorf("%q ≠ %q", got, want)
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readers blocked by a slow stream")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	close(drop)
+	for i := 0; i < cap(failed); i++ {
+		select {
+		case err := <-failed:
+			if err == nil {
+				t.Error("dropped transfer read as the song")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read of a dropped transfer blocked")
+		}
+	}
+	clunk(df, dropped)
+
+	streams.Lock()
+	src = streams.m[slow.Fid]
+	streams.Unlock()
+	for src.TryLock() { // until the read is in progress
+		src.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	clunked := make(chan struct{})
+	go func() {
+		sf.Clunk(slow)
+		close(clunked)
+	}()
+	select {
+	case <-clunked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("clunk blocked by a slow stream")
+	}
+	select {
+	case err := <-blocked:
+		if err == nil {
+			t.Error("aborted read succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not aborted by clunk")
+	}
+	sf.FidDestroy(slow)
+	streams.Lock()
+	n := len(streams.m)
+	streams.Unlock()
+	if n != 0 {
+		t.Error(n, "streams left")
+	}
+}
+
+// clunk clunks fid, then destroys it as the server does once no request
+// uses it anymore.
+func clunk(f *SongFile, fid *srv.FFid) {
+	f.Clunk(fid)
+	f.FidDestroy(fid)
+}
+
+func TestReadAfterClunk(t *testing.T) {
+	calls := 0
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("song"))
+	})
+	f := &SongFile{id: "1"}
+	fid := &srv.FFid{Fid: &srv.Fid{}}
+	f.Clunk(fid) // before a Read in progress reaches the stream
+	if _, err := f.Read(fid, make([]byte, 64), 0); err == nil {
+		t.Error("clunked fid read")
+	}
+	if calls != 0 {
+		t.Error("transfer reopened for a clunked fid")
+	}
+	f.FidDestroy(fid)
+	streams.Lock()
+	_, ok := streams.m[fid.Fid]
+	streams.Unlock()
+	if ok {
+		t.Error("stream left after the fid was destroyed")
+	}
+}
+
+func TestReadError(t *testing.T) {
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"subsonic-response":{"status":"failed","version":"1.8.0","error":{"code":0,"message":"Transcoder failed"}}}`))
+	})
+	f := &SongFile{id: "1"}
+	fid := &srv.FFid{Fid: &srv.Fid{}}
+	defer clunk(f, fid)
+	n, err := f.Read(fid, make([]byte, 64), 0)
+	if n != 0 || err == nil {
+		t.Fatal("error read as the song:", n, err)
+	}
+	if e, ok := err.(*p.Error); !ok || e.Err != "Transcoder failed" || e.Errornum != p.EIO {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestTransferUnlimited(t *testing.T) {
+	var got string
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		got = path.Base(r.URL.Path) + " " + r.URL.Query().Get("maxBitRate")
+		w.Write([]byte("song"))
+	})
+	defer func(n int) { *maxbps = n }(*maxbps)
+	*maxbps = 0
+	tr, err := transfer(context.Background(), "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Close()
+	// the download role is not needed:
+	if want := "stream.view 0"; got != want {
+		t.Error(got, "≠", want)
+	}
+}
+
+func TestDirStat(t *testing.T) {
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "getArtist.view":
+			fmt.Fprintf(w, okResp, `"artist":{"id":"ar","name":"a","album":[
+				{"id":"1","name":"x","songCount":2,"created":"2013-03-18T12:21:33"},
+				{"id":"2","name":"y","songCount":1,"created":"2014-05-01T08:00:00"}]}`)
+		case "getAlbum.view":
+			fmt.Fprintf(w, okResp, `"album":{"id":"1","song":[
+				{"id":"s1","title":"a","track":1,"suffix":"mp3","size":1000,"bitRate":128,"duration":10,"created":"2013-03-12T11:32:55"},
+				{"id":"s2","title":"b","track":2,"suffix":"mp3","size":500000,"bitRate":320,"duration":10,"created":"2013-03-12T11:33:43"}]}`)
+		default:
+			w.Write([]byte("song " + r.URL.Query().Get("id")))
+		}
+	})
+	if err := parseTemplates(); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	defer func(n int) { *maxbps = n }(*maxbps)
+	*maxbps = 192
+	date := func(s string) uint32 {
+		d, err := time.Parse("2006-01-02T15:04:05", s)
+		if err != nil {
+			t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+		}
+		return uint32(d.Unix())
+	}
+
+	root := &srv.File{}
+	root.Add(nil, "/", owner, nil, dirperm, nil)
+	ar := &ArtistDir{id: "ar"}
+	ar.Add(root, "a", owner, nil, dirperm, ar)
+	ctx := context.Background()
+	if err := ar.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := date("2014-05-01T08:00:00"); ar.Mtime != want || ar.Atime != want {
+		t.Error("artist:", ar.Mtime, ar.Atime, "≠", want)
+	}
+	al, ok := ar.Find("x").Ops.(*AlbumDir)
+	if !ok {
+		t.Fatal("album not loaded")
+	}
+	if err := al.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := date("2013-03-18T12:21:33"); al.Mtime != want {
+		t.Error("album:", al.Mtime, "≠", want)
+	}
+	tests := []struct {
+		name   string
+		length uint64
+		mtime  string
+	}{
+		{"01_a.mp3", 1000, "2013-03-12T11:32:55"},
+		{"02_b.mp3", 10 * 192 * 1000 / 8, "2013-03-12T11:33:43"}, // transcoded
+	}
+	for _, tt := range tests {
+		f := al.Find(tt.name)
+		if f == nil {
+			t.Fatal(tt.name, "not found")
+		}
+		if f.Length != tt.length || f.Mtime != date(tt.mtime) {
+			t.Error(tt.name, ":", f.Length, f.Mtime, "≠", tt.length, date(tt.mtime))
+		}
+	}
+
+	// the estimate is corrected at the end of the transfer:
+	sf := al.Find("02_b.mp3").Ops.(*SongFile)
+	fid := &srv.FFid{Fid: &srv.Fid{}}
+	defer clunk(sf, fid)
+	buf := make([]byte, 64)
+	for off := uint64(0); ; {
+		n, err := sf.Read(fid, buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		off += uint64(n)
+	}
+	if n := uint64(len("song s2")); sf.Length != n {
+		t.Error(sf.Length, "≠", n)
+	}
+}
+
+func TestDiscLayout(t *testing.T) {
+	two := `{"id":"1","title":"a","track":1,"discNumber":1,"suffix":"mp3"},
+		{"id":"2","title":"b","track":2,"suffix":"mp3"},
+		{"id":"3","title":"c","track":1,"discNumber":2,"suffix":"mp3"}`
+	one := `{"id":"1","title":"a","track":1,"discNumber":1,"suffix":"mp3"},
+		{"id":"2","title":"b","track":2,"suffix":"mp3"}`
+	var songs string
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, okResp, `"album":{"id":"1","song":[`+songs+`]}`)
+	})
+	if err := parseTemplates(); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	defer func(s string) { *disc = s }(*disc)
+	tests := []struct {
+		layout string
+		songs  string
+		files  []string
+	}{
+		{"prefix", two, []string{"1-01_a.mp3", "1-02_b.mp3", "2-01_c.mp3"}},
+		{"dir", two, []string{"disc1/01_a.mp3", "disc1/02_b.mp3", "disc2/01_c.mp3"}},
+		{"none", two, []string{"01_a.mp3", "02_b.mp3", "01_c.mp3"}},
+		{"prefix", one, []string{"01_a.mp3", "02_b.mp3"}},
+		{"dir", one, []string{"01_a.mp3", "02_b.mp3"}},
+	}
+	for _, tt := range tests {
+		*disc, songs = tt.layout, tt.songs
+		root := &srv.File{}
+		root.Add(nil, "/", owner, nil, dirperm, nil)
+		d := &AlbumDir{id: "1"}
+		d.Add(root, "album", owner, nil, dirperm, d)
+		if err := d.load(context.Background()); err != nil {
+			t.Fatal(tt.layout, err)
+		}
+		var got []string
+		for _, s := range d.songs {
+			name := s.Name
+			if s.Parent != &d.File {
+				name = s.Parent.Name + "/" + name
+			}
+			got = append(got, name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.files) {
+			t.Error(tt.layout, ":", got, "≠", tt.files)
+		}
+	}
+}
+
+func TestFsError(t *testing.T) {
+	tests := []struct {
+		err  error
+		msg  string
+		code uint32
+	}{
+		{&subsonic.ReqError{Code: 70, Message: "Album not found"}, "file does not exist", p.ENOENT},
+		{fmt.Errorf("could not load: %w", &subsonic.ReqError{Code: 50, Message: "no"}), "permission denied", p.EPERM},
+		{&subsonic.ReqError{Code: 40, Message: "Wrong username or password"}, "permission denied", p.EPERM},
+		{&subsonic.ReqError{Code: 0, Message: "boom"}, "boom", p.EIO},
+		{fmt.Errorf("timeout"), "timeout", p.EIO},
+		{srv.Enoent, srv.Enoent.Err, p.ENOENT},
+	}
+	for _, tt := range tests {
+		e, ok := fsError(tt.err).(*p.Error)
+		if !ok || e.Err != tt.msg || e.Errornum != tt.code {
+			t.Error(tt.err, ":", e, "≠", tt.msg, tt.code)
+		}
+	}
+	if fsError(nil) != nil {
+		t.Error("nil error mapped")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var srepl = strings.NewReplacer(
+	`"`, "_",
+	" ", "␣",
+	"/", "_", // mandatory
+	"'", "_",
+	"(", "_",
+	")", "_",
+	"#", "_",
+	"&", "and",
+)
+
+func tr(s string) string {
+	return srepl.Replace(strings.ToLower(s))
+}
+
+// A sanitizer turns a string into a valid file name.
+type sanitizer func(string) string
+
+var sanitizers = map[string]sanitizer{
+	// lowercase, with a few troublesome characters replaced
+	"legacy": tr,
+	// only letters, digits, '.', '_' and '-' (the POSIX portable
+	// file name character set)
+	"posix": posixName,
+	// case and Unicode preserved, only '/' and control characters
+	// replaced
+	"unicode": unicodeName,
+}
+
+func posixName(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			b = append(b, byte(r))
+		case len(b) == 0 || b[len(b)-1] != '_':
+			b = append(b, '_')
+		}
+	}
+	s = string(b)
+	if strings.HasPrefix(s, "-") {
+		s = "_" + s
+	}
+	return dotName(s)
+}
+
+func unicodeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return dotName(s)
+}
+
+// dotName makes sure s is not "." or "..".
+func dotName(s string) string {
+	if s == "." || s == ".." {
+		return strings.Repeat("_", len(s))
+	}
+	return s
+}
+
+// nameTemplate is a file name template: text with {field} placeholders,
+// or {field:0N} to zero pad a numeric field to N digits. The expanded
+// template is passed to a sanitizer.
+type nameTemplate struct {
+	parts []tmplPart
+	san   sanitizer
+}
+
+type tmplPart struct {
+	text  string // literal text, if field is empty
+	field string
+	width int
+}
+
+// parseTemplate parses a template using the given fields, mapped to
+// whether they are numeric, and the named sanitizer.
+func parseTemplate(s string, fields map[string]bool, san string) (*nameTemplate, error) {
+	t := &nameTemplate{san: sanitizers[san]}
+	if t.san == nil {
+		return nil, fmt.Errorf("unknown sanitizer `%s'", san)
+	}
+	for s != "" {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t.parts = append(t.parts, tmplPart{text: s})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, tmplPart{text: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("template `%s': unclosed `{'", s)
+		}
+		p := tmplPart{field: s[i+1 : i+j]}
+		if k := strings.IndexByte(p.field, ':'); k >= 0 {
+			w, err := strconv.Atoi(p.field[k+1:])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("template `%s': bad width in `%s'", s, s[i:i+j+1])
+			}
+			p.field, p.width = p.field[:k], w
+		}
+		numeric, ok := fields[p.field]
+		if !ok {
+			return nil, fmt.Errorf("template `%s': unknown field `%s'", s, p.field)
+		}
+		if p.width > 0 && !numeric {
+			return nil, fmt.Errorf("template `%s': width given for non-numeric field `%s'", s, p.field)
+		}
+		t.parts = append(t.parts, p)
+		s = s[i+j+1:]
+	}
+	return t, nil
+}
+
+// has reports whether t uses field.
+func (t *nameTemplate) has(field string) bool {
+	for _, p := range t.parts {
+		if p.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// exec expands the template with vals, which holds strings and ints.
+func (t *nameTemplate) exec(vals map[string]interface{}) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch v := vals[p.field].(type) {
+		case int:
+			fmt.Fprintf(&b, "%0*d", p.width, v)
+		case string:
+			b.WriteString(v)
+		default:
+			b.WriteString(p.text)
+		}
+	}
+	return t.san(b.String())
+}
+
+// entry is a directory entry named after a server object.
+type entry struct {
+	name   string
+	id     string
+	mtime  time.Time
+	length uint64
+}
+
+// uniq makes the names of entries, which belong to the same directory,
+// unique. Of the entries sharing a name, the one with the lowest id
+// keeps it and the others get their id appended (before the extension,
+// if ext is set): the result does not depend on the order the server
+// lists them, so every object keeps its path across reloads.
+func uniq(entries []entry, ext bool) {
+	groups := make(map[string][]int)
+	for i := range entries {
+		if entries[i].name == "" {
+			entries[i].name = "_" + safeId(entries[i].id)
+		}
+		n := entries[i].name
+		groups[n] = append(groups[n], i)
+	}
+	taken := make(map[string]bool)
+	var clashes [][]int
+	for n, g := range groups {
+		taken[n] = true
+		if len(g) > 1 {
+			sort.Slice(g, func(i, j int) bool {
+				return idLess(entries[g[i]].id, entries[g[j]].id)
+			})
+			clashes = append(clashes, g)
+		}
+	}
+	// visit the clashes in a fixed order, as the renamed entries may
+	// clash again
+	sort.Slice(clashes, func(i, j int) bool {
+		return entries[clashes[i][0]].name < entries[clashes[j][0]].name
+	})
+	for _, g := range clashes {
+		for _, i := range g[1:] {
+			n := entries[i].name
+			for taken[n] {
+				n = withSuffix(n, "_"+safeId(entries[i].id), ext)
+			}
+			taken[n] = true
+			entries[i].name = n
+		}
+	}
+}
+
+// safeId returns id as usable in a file name.
+func safeId(id string) string {
+	return strings.Replace(id, "/", "_", -1)
+}
+
+func withSuffix(name, suffix string, ext bool) string {
+	if !ext {
+		return name + suffix
+	}
+	e := path.Ext(name)
+	return strings.TrimSuffix(name, e) + suffix + e
+}
+
+// idLess orders ids numerically when possible.
+func idLess(a, b string) bool {
+	x, errx := strconv.ParseInt(a, 10, 64)
+	y, erry := strconv.ParseInt(b, 10, 64)
+	if errx == nil && erry == nil {
+		return x < y
+	}
+	return a < b
+}
+
+var (
+	artistFields = map[string]bool{"name": false, "id": false}
+	albumFields  = map[string]bool{
+		"name":   false,
+		"album":  false,
+		"id":     false,
+		"artist": false,
+		"genre":  false,
+		"year":   true,
+	}
+	songFields = map[string]bool{
+		"title":  false,
+		"id":     false,
+		"suffix": false,
+		"artist": false,
+		"album":  false,
+		"genre":  false,
+		"track":  true,
+		"disc":   true,
+		"year":   true,
+	}
+
+	artistTmpl, albumTmpl *nameTemplate
+	songTmpl              *nameTemplate
+	multiTmpl             *nameTemplate // songs of multi-disc albums, in prefix layout
+)
+
+// parseTemplates compiles the file name templates given by flags.
+func parseTemplates() (err error) {
+	if artistTmpl, err = parseTemplate(*artistfmt, artistFields, *artistsan); err != nil {
+		return err
+	}
+	if albumTmpl, err = parseTemplate(*albumfmt, albumFields, *albumsan); err != nil {
+		return err
+	}
+	if songTmpl, err = parseTemplate(*songfmt, songFields, *songsan); err != nil {
+		return err
+	}
+	multi := *songfmt
+	if !songTmpl.has("disc") {
+		multi = "{disc}-" + multi
+	}
+	multiTmpl, err = parseTemplate(multi, songFields, *songsan)
+	return err
+}
+
+func artistName(a subsonic.Artist) string {
+	return artistTmpl.exec(map[string]interface{}{
+		"name": a.Name,
+		"id":   a.Id,
+	})
+}
+
+func albumName(a subsonic.Album) string {
+	return albumTmpl.exec(map[string]interface{}{
+		"name":   a.Name,
+		"album":  a.Name,
+		"id":     a.Id,
+		"artist": a.Artist,
+		"genre":  a.Genre,
+		"year":   a.Year,
+	})
+}
+
+func songName(t *nameTemplate, s subsonic.Song) string {
+	return t.exec(map[string]interface{}{
+		"title":  s.Name,
+		"id":     s.Id,
+		"suffix": s.Suffix,
+		"artist": s.Artist,
+		"album":  s.Album,
+		"genre":  s.Genre,
+		"track":  s.Number,
+		"disc":   s.DiscNumber,
+		"year":   s.Year,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUniq(t *testing.T) {
+	names := func(entries []entry) []string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, e.name)
+		}
+		return s
+	}
+	tests := []struct {
+		in   []entry
+		ext  bool
+		want []string
+	}{
+		{
+			[]entry{{name: "ac_dc", id: "7"}, {name: "queen", id: "3"}},
+			false,
+			[]string{"ac_dc", "queen"},
+		},
+		{
+			// the lowest id keeps the name, whatever the order
+			[]entry{{name: "ac_dc", id: "12"}, {name: "ac_dc", id: "9"}},
+			false,
+			[]string{"ac_dc_12", "ac_dc"},
+		},
+		{
+			[]entry{{name: "ac_dc", id: "9"}, {name: "ac_dc", id: "12"}},
+			false,
+			[]string{"ac_dc", "ac_dc_12"},
+		},
+		{
+			[]entry{{name: "01_intro.mp3", id: "b"}, {name: "01_intro.mp3", id: "a"}},
+			true,
+			[]string{"01_intro_b.mp3", "01_intro.mp3"},
+		},
+		{
+			// renamed entries must not clash with existing ones
+			[]entry{{name: "x", id: "1"}, {name: "x", id: "2"}, {name: "x_2", id: "3"}},
+			false,
+			[]string{"x", "x_2_2", "x_2"},
+		},
+		{
+			[]entry{{name: "", id: "a/b"}},
+			false,
+			[]string{"_a_b"},
+		},
+	}
+	for _, tt := range tests {
+		uniq(tt.in, tt.ext)
+		got := names(tt.in)
+		if len(got) != len(tt.want) {
+			t.Fatal(got, "≠", tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Error(got, "≠", tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSanitizers(t *testing.T) {
+	tests := []struct {
+		san, in, out string
+	}{
+		{"legacy", "AC/DC (Live) & Co.", "ac_dc␣_live_␣and␣co."},
+		{"posix", "AC/DC (Live) & Co.", "AC_DC_Live_Co."},
+		{"posix", "-Édith Piaf", "_-_dith_Piaf"},
+		{"posix", "..", "__"},
+		{"unicode", "AC/DC (Live) & Co.", "AC_DC (Live) & Co."},
+		{"unicode", "Sigur Rós\t", "Sigur Rós_"},
+		{"unicode", ".", "_"},
+	}
+	for _, tt := range tests {
+		if out := sanitizers[tt.san](tt.in); out != tt.out {
+			t.Error(tt.san, ":", out, "≠", tt.out)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	tests := []struct {
+		tmpl, san, out string
+	}{
+		{"{track:02}_{title}.{suffix}", "legacy", "03_free␣bird.mp3"},
+		{"{disc}-{track:02} {title}.{suffix}", "unicode", "2-03 Free Bird.mp3"},
+		{"{year} - {album}", "unicode", "1973 - Pronounced"},
+		{"{track:03}{title}", "posix", "003Free_Bird"},
+		{"no fields", "legacy", "no␣fields"},
+	}
+	vals := map[string]interface{}{
+		"title":  "Free Bird",
+		"album":  "Pronounced",
+		"suffix": "mp3",
+		"track":  3,
+		"disc":   2,
+		"year":   1973,
+	}
+	for _, tt := range tests {
+		tmpl, err := parseTemplate(tt.tmpl, songFields, tt.san)
+		if err != nil {
+			t.Error(tt.tmpl, ": unexpected error:", err)
+			continue
+		}
+		if out := tmpl.exec(vals); out != tt.out {
+			t.Error(tt.tmpl, ":", out, "≠", tt.out)
+		}
+	}
+
+	for _, s := range []string{"{title", "{nope}", "{title:02}", "{track:x}"} {
+		if _, err := parseTemplate(s, songFields, "legacy"); err == nil {
+			t.Error(s, ": expected error found nil")
+		}
+	}
+	if _, err := parseTemplate("{title}", songFields, "nope"); err == nil {
+		t.Error("unknown sanitizer: expected error found nil")
+	}
+}
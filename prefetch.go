@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+	"code.google.com/p/go9p/p/srv"
+
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// prefetches holds the songs being downloaded into the cache ahead of
+// the readers, by cache key, and the readers which asked for them, by
+// the song they read. A reader is someone playing an album: it moves to
+// the next song once the previous one was read to the end, keeping the
+// downloads it started. Anything else, e.g. a tool reading the header of
+// a song, or another player, even over the same 9P connection as with a
+// kernel mount, is a reader of its own and cannot cancel them.
+var prefetches = struct {
+	sync.Mutex
+	jobs    map[string]*prefetchJob
+	readers map[*SongFile]*reader
+}{
+	jobs:    make(map[string]*prefetchJob),
+	readers: make(map[*SongFile]*reader),
+}
+
+type prefetchJob struct {
+	cache  *songCache
+	cancel context.CancelFunc
+	hurry  chan struct{} // closed once the song is being read
+	once   sync.Once
+
+	mu    sync.Mutex
+	w     *cacheWriter  // nil until the transfer is open
+	n     int64         // bytes written so far
+	end   bool          // finished
+	ok    bool          // finished and added to the cache
+	grown chan struct{} // closed, and replaced, as n grows or at the end
+}
+
+type reader struct {
+	fid  *srv.Fid // fid reading the song
+	eof  bool     // the song was read to the end
+	jobs map[string]*prefetchJob
+}
+
+// speedUp lifts the bandwidth limit of the job.
+func (j *prefetchJob) speedUp() {
+	j.once.Do(func() { close(j.hurry) })
+}
+
+// Write writes to the cache, waking up the readers of the song.
+func (j *prefetchJob) Write(p []byte) (int, error) {
+	n, err := j.w.Write(p)
+	j.mu.Lock()
+	j.n += int64(n)
+	close(j.grown)
+	j.grown = make(chan struct{})
+	j.mu.Unlock()
+	return n, err
+}
+
+// finish records the end of the job.
+func (j *prefetchJob) finish(ok bool) {
+	j.mu.Lock()
+	j.end, j.ok = true, ok
+	close(j.grown)
+	j.grown = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// readAhead starts downloading into the cache the songs following f in
+// its album, as fid starts reading it. If fid continues the reading of
+// the album, the downloads previously started and no longer needed are
+// cancelled, except the one of f itself, which fid reads as it goes.
+func readAhead(f *SongFile, fid *srv.Fid) {
+	if cache == nil || *prefetch <= 0 || f.album == nil {
+		return
+	}
+	next := f.album.next(f, *prefetch)
+	want := make(map[string]string) // song ids by key
+	for _, s := range next {
+		want[songKey(s.id)] = s.id
+	}
+
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	r := prefetches.readers[f]
+	switch {
+	case r != nil && r.fid != fid && !r.eof:
+		return // read by someone else, who started the downloads
+	case r == nil:
+		r = &reader{jobs: make(map[string]*prefetchJob)}
+		if prev := f.album.prev(f); prev != nil {
+			if pr := prefetches.readers[prev]; pr != nil && pr.eof {
+				delete(prefetches.readers, prev)
+				r = pr
+			}
+		}
+	}
+	r.fid, r.eof = fid, false
+	cur := songKey(f.id)
+	for key, j := range r.jobs {
+		if _, ok := want[key]; !ok && key != cur {
+			j.cancel()
+			delete(r.jobs, key)
+		}
+	}
+	for key, id := range want {
+		if prefetches.jobs[key] != nil || cache.has(key) {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		j := &prefetchJob{
+			cache:  cache,
+			cancel: cancel,
+			hurry:  make(chan struct{}),
+			grown:  make(chan struct{}),
+		}
+		prefetches.jobs[key] = j
+		r.jobs[key] = j
+		go j.run(ctx, id, key)
+	}
+	if len(r.jobs) > 0 {
+		prefetches.readers[f] = r
+	} else {
+		delete(prefetches.readers, f)
+	}
+}
+
+// endReadAhead records that fid read f to the end: reading the next
+// song of the album continues its read-ahead.
+func endReadAhead(f *SongFile, fid *srv.Fid) {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	if r := prefetches.readers[f]; r != nil && r.fid == fid {
+		r.eof = true
+	}
+}
+
+// stopReadAhead cancels the downloads started for the reader of f, if
+// still reading it through fid.
+func stopReadAhead(f *SongFile, fid *srv.Fid) {
+	prefetches.Lock()
+	defer prefetches.Unlock()
+	r := prefetches.readers[f]
+	if r == nil || r.fid != fid {
+		return
+	}
+	for _, j := range r.jobs {
+		j.cancel()
+	}
+	delete(prefetches.readers, f)
+}
+
+// prefetched returns the song with the given key being downloaded, if
+// any, letting its download use all the bandwidth as it is now needed.
+func prefetched(key string) *partial {
+	prefetches.Lock()
+	j := prefetches.jobs[key]
+	prefetches.Unlock()
+	if j == nil {
+		return nil
+	}
+	j.speedUp()
+	return &partial{j: j, key: key}
+}
+
+func (j *prefetchJob) run(ctx context.Context, song, key string) {
+	ok := false
+	defer func() {
+		j.cancel()
+		j.finish(ok)
+		prefetches.Lock()
+		defer prefetches.Unlock()
+		if prefetches.jobs[key] == j {
+			delete(prefetches.jobs, key)
+		}
+		for f, r := range prefetches.readers {
+			if r.jobs[key] == j {
+				delete(r.jobs, key)
+				if len(r.jobs) == 0 {
+					delete(prefetches.readers, f)
+				}
+			}
+		}
+	}()
+	t, err := client.TryStreamAtContext(ctx, song, *maxbps, 0)
+	if err != nil {
+		if err != subsonic.ErrBusy { // skipped, streams are for the readers
+			log.Printf("could not prefetch song %s: %s\n", song, err)
+		}
+		return
+	}
+	defer t.Close()
+	w, err := j.cache.create(key)
+	if err != nil {
+		log.Printf("could not prefetch song %s: %s\n", song, err)
+		return
+	}
+	j.mu.Lock()
+	j.w = w
+	j.mu.Unlock()
+	var src io.Reader = t
+	if *prefetbw > 0 {
+		src = &slowReader{ctx: ctx, r: t, rate: int64(*prefetbw) << 10, start: time.Now(), hurry: j.hurry}
+	}
+	if _, err := io.Copy(j, src); err != nil {
+		w.abort()
+		if ctx.Err() == nil {
+			log.Printf("could not prefetch song %s: %s\n", song, err)
+		}
+		return
+	}
+	if err := w.commit(); err != nil {
+		log.Printf("could not prefetch song %s: %s\n", song, err)
+		return
+	}
+	ok = true
+}
+
+// errPrefetch tells a partial song is not available anymore, as its
+// download failed: it has to be transferred again.
+var errPrefetch = errors.New("prefetch failed")
+
+// partial is a song being prefetched, read as it is downloaded.
+type partial struct {
+	j   *prefetchJob
+	key string
+	f   *os.File // nil until the download starts
+}
+
+// readAt reads like ReadAt, waiting for the bytes at off to be
+// downloaded, unless ctx is done first. It fails with errPrefetch if
+// the download failed before reaching off.
+func (p *partial) readAt(ctx context.Context, buf []byte, off int64) (int, error) {
+	j := p.j
+	for {
+		j.mu.Lock()
+		n, w, end, ok, grown := j.n, j.w, j.end, j.ok, j.grown
+		j.mu.Unlock()
+		if off < n && p.f == nil {
+			var err error
+			if ok {
+				p.f, err = j.cache.open(p.key)
+			} else {
+				p.f, err = os.Open(w.f.Name())
+			}
+			if err != nil {
+				j.mu.Lock()
+				renamed := !ok && j.ok
+				j.mu.Unlock()
+				if renamed {
+					continue // added to the cache meanwhile
+				}
+				return 0, errPrefetch // evicted, or aborted
+			}
+		}
+		switch {
+		case off < n:
+			if max := n - off; int64(len(buf)) > max {
+				buf = buf[:max]
+			}
+			c, err := p.f.ReadAt(buf, off)
+			if err == io.EOF {
+				err = nil
+			}
+			return c, err
+		case end && ok:
+			return 0, io.EOF
+		case end:
+			return 0, errPrefetch
+		}
+		select {
+		case <-grown:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (p *partial) Close() error {
+	if p.f == nil {
+		return nil
+	}
+	return p.f.Close()
+}
+
+// slowReader limits the rate of reads from r to rate bytes per second,
+// leaving the rest of the bandwidth to the songs being played, until
+// hurry is closed.
+type slowReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+	hurry <-chan struct{}
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	select {
+	case <-s.hurry:
+		return s.r.Read(p)
+	default:
+	}
+	if max := s.rate / 10; int64(len(p)) > max && max > 0 {
+		p = p[:max] // keep the pace smooth
+	}
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	wait := time.Duration(s.n*int64(time.Second)/s.rate) - time.Since(s.start)
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-s.hurry:
+		case <-s.ctx.Done():
+			return n, s.ctx.Err()
+		}
+	}
+	return n, err
+}
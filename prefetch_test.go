@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+	"code.google.com/p/go9p/p/srv"
+
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a fake subsonic server streaming, for song id,
+// the string "song <id>", and points client to it.
+func newTestServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	if h == nil {
+		h = func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("song " + r.URL.Query().Get("id")))
+		}
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	old := client
+	client = subsonic.NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	t.Cleanup(func() { client = old })
+	return ts
+}
+
+func newTestCache(t *testing.T) {
+	c, err := openCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cache
+	cache = c
+	t.Cleanup(func() { cache = old })
+}
+
+func newTestAlbum(n int) *AlbumDir {
+	d := &AlbumDir{}
+	for i := 0; i < n; i++ {
+		d.songs = append(d.songs, &SongFile{id: string(rune('a' + i)), album: d})
+	}
+	return d
+}
+
+// waitPrefetches waits for the prefetches in progress to end, so that
+// none outlives its test.
+func waitPrefetches(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prefetches.Lock()
+		n := len(prefetches.jobs)
+		prefetches.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("prefetches not done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	newTestServer(t, nil)
+	newTestCache(t)
+	defer func(n int) { *prefetch = n }(*prefetch)
+	*prefetch = 2
+	defer waitPrefetches(t)
+
+	d := newTestAlbum(4)
+	readAhead(d.songs[0], &srv.Fid{})
+	deadline := time.Now().Add(5 * time.Second)
+	for !cache.has(songKey("b")) || !cache.has(songKey("c")) {
+		if time.Now().After(deadline) {
+			t.Fatal("songs not prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.has(songKey("d")) {
+		t.Error("prefetched past the window")
+	}
+	if s, ok := get(cache, songKey("b")); !ok || s != "song b" {
+		t.Error("b:", s, ok)
+	}
+}
+
+func TestReadAheadCancel(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan string, 10)
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Query().Get("id")
+		w.(http.Flusher).Flush()
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	})
+	newTestCache(t)
+	defer func(n int) { *prefetch = n }(*prefetch)
+	*prefetch = 1
+
+	d := newTestAlbum(3)
+	fid := &srv.Fid{}
+	readAhead(d.songs[0], fid)
+	if id := <-started; id != "b" {
+		t.Fatal(id, "≠", "b")
+	}
+	stopReadAhead(d.songs[0], fid)
+	waitPrefetches(t)
+	if cache.has(songKey("b")) {
+		t.Error("cancelled prefetch cached")
+	}
+}
+
+func TestReadAheadReaders(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan string, 10)
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Query().Get("id")
+		w.(http.Flusher).Flush()
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	})
+	newTestCache(t)
+	defer func(n int) { *prefetch = n }(*prefetch)
+	*prefetch = 1
+
+	d := newTestAlbum(4)
+	player := &srv.Fid{}
+	readAhead(d.songs[0], player)
+	if id := <-started; id != "b" {
+		t.Fatal(id, "≠", "b")
+	}
+	// tools reading a song header over the same connection:
+	for _, s := range []*SongFile{d.songs[0], d.songs[2]} {
+		probe := &srv.Fid{Fconn: player.Fconn}
+		readAhead(s, probe)
+		stopReadAhead(s, probe)
+	}
+	time.Sleep(20 * time.Millisecond)
+	prefetches.Lock()
+	b, c := prefetches.jobs[songKey("b")], prefetches.jobs[songKey("d")]
+	prefetches.Unlock()
+	if b == nil {
+		t.Error("player prefetch cancelled by another reader")
+	}
+	if c != nil {
+		t.Error("prefetch of an early clunk not cancelled")
+	}
+	stopReadAhead(d.songs[0], player)
+	waitPrefetches(t)
+}
+
+func TestReadAheadCurrent(t *testing.T) {
+	block := make(chan struct{})
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		mu.Lock()
+		calls[id]++
+		mu.Unlock()
+		w.Write([]byte("song "))
+		w.(http.Flusher).Flush()
+		if id == "b" {
+			<-block
+		}
+		w.Write([]byte(id))
+	})
+	newTestCache(t)
+	defer func(n int) { *prefetch = n }(*prefetch)
+	*prefetch = 1
+	defer func(n int) { *prefetbw = n }(*prefetbw)
+	*prefetbw = 1
+	defer waitPrefetches(t)
+
+	d := newTestAlbum(3)
+	readAll := func(f *SongFile, fid *srv.FFid) string {
+		var got []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := f.Read(fid, buf, uint64(len(got)))
+			if err != nil {
+				t.Error(err)
+			}
+			if n == 0 || err != nil {
+				return string(got)
+			}
+			got = append(got, buf[:n]...)
+		}
+	}
+	a := &srv.FFid{Fid: &srv.Fid{}}
+	defer clunk(d.songs[0], a)
+	if s := readAll(d.songs[0], a); s != "song a" {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", s)
+	}
+	// the player moves to b while it is prefetched, and gets the
+	// downloaded part at once:
+	b := &srv.FFid{Fid: &srv.Fid{}}
+	defer clunk(d.songs[1], b)
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := d.songs[1].Read(b, buf, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- string(buf[:n])
+	}()
+	select {
+	case s := <-read:
+		if s != "song " {
+			t.Error(s, "≠", "song ")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read waited for the whole prefetch")
+	}
+	close(block)
+	buf := make([]byte, 64)
+	var rest []byte
+	for {
+		n, err := d.songs[1].Read(b, buf, uint64(len("song ")+len(rest)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		rest = append(rest, buf[:n]...)
+	}
+	if string(rest) != "b" {
+		t.Error(string(rest), "≠", "b")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["b"] != 1 {
+		t.Error("b transferred", calls["b"], "times")
+	}
+}
+
+func TestReadAheadStreams(t *testing.T) {
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == "a" {
+			w.Write(bytes.Repeat([]byte("a"), 64))
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // a long prefetch
+	})
+	client.SetLimits(subsonic.Limits{Streams: 1})
+	newTestCache(t)
+	defer func(n int) { *prefetch = n }(*prefetch)
+	*prefetch = 1
+	defer waitPrefetches(t)
+
+	d := newTestAlbum(2)
+	fid := &srv.FFid{Fid: &srv.Fid{}}
+	defer clunk(d.songs[0], fid)
+	buf := make([]byte, 8)
+	if _, err := d.songs[0].Read(fid, buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	// seeking reopens the transfer, whose stream is not taken by the
+	// prefetch of b:
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.songs[0].Read(fid, buf, 20)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		cancelFid(fid.Fid)
+		t.Fatal("read blocked by the prefetch")
+	}
+}
+
+func TestSlowReader(t *testing.T) {
+	data := make([]byte, 2<<10)
+	r := &slowReader{
+		ctx:   context.Background(),
+		r:     bytes.NewReader(data),
+		rate:  10 << 10,
+		start: time.Now(),
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(r.start); d < 150*time.Millisecond {
+		t.Error("too fast:", d)
+	}
+	if buf.Len() != len(data) {
+		t.Error(buf.Len(), "≠", len(data))
+	}
+
+	hurry := make(chan struct{})
+	close(hurry)
+	r = &slowReader{
+		ctx:   context.Background(),
+		r:     bytes.NewReader(data),
+		rate:  1,
+		start: time.Now(),
+		hurry: hurry,
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(r.start); d > time.Second {
+		t.Error("still limited:", d)
+	}
+}
@@ -1,401 +1,1046 @@
 package subsonic
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func (c *Client) doReq(url string) ([]byte, error) {
-	resp, err := c.cli.Get(url)
+func (c *Client) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
+	return c.cli.Do(req)
+}
+
+// doReq calls the given API method and returns the raw response.
+// Failures other than errors reported by the server are returned as
+// *CallError, after the retries of the retry policy. In FormatAuto, a
+// malformed JSON response switches the client to XML for good, and the
+// request is repeated.
+func (c *Client) doReq(ctx context.Context, method string, q url.Values) ([]byte, error) {
+	data, err := c.call(ctx, method, q)
+	if c.tokenFallback(data, err) {
+		data, err = c.call(ctx, method, q)
+	}
+	var ce *CallError
+	if !errors.As(err, &ce) || ce.Kind != KindMalformed {
+		return data, err
+	}
+	c.mu.Lock()
+	fallback := c.format == FormatAuto && !c.xml
+	if fallback {
+		c.xml = true
+	}
+	c.mu.Unlock()
+	if fallback {
+		return c.call(ctx, method, q)
+	}
+	return nil, err
+}
+
+// tokenFallback switches to the hex-encoded password if the response
+// data or err of a call tells token authentication is not supported: by
+// servers older than 1.13.0, or for some accounts (e.g. LDAP ones). It
+// reports whether it switched.
+func (c *Client) tokenFallback(data []byte, err error) bool {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+	if !token {
+		return false
+	}
+	if err == nil && bytes.Contains(data, []byte("failed")) {
+		_, err = decode(data)
+	}
+	var e *ReqError
+	if !errors.As(err, &e) || (e.Code != 30 && e.Code != 41) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.token {
+		return false
+	}
+	c.token = false
+	return true
+}
+
+// fetch requests u, calling the given API method, and returns the body
+// of the response, if it is a well-formed one.
+func (c *Client) fetch(ctx context.Context, method, u string) ([]byte, error) {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, newCallError(KindNetwork, method, u, 0, err)
+	}
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newCallError(KindNetwork, method, u, resp.StatusCode, err)
+	}
+	if isHTML(resp, data) {
+		ce := newCallError(KindHTML, method, u, resp.StatusCode, nil)
+		ce.RetryAfter = retryAfter(resp)
+		return nil, ce
+	}
+	if resp.StatusCode/100 != 2 {
+		if _, err := decode(data); err != nil {
+			if e, ok := err.(*ReqError); ok {
+				return nil, e
+			}
+		}
+		ce := newCallError(KindStatus, method, u, resp.StatusCode, nil)
+		ce.RetryAfter = retryAfter(resp)
+		return nil, ce
+	}
+	if err := checkPayload(data); err != nil {
+		return nil, newCallError(KindMalformed, method, u, resp.StatusCode, err)
+	}
+	return data, nil
 }
 
 const (
 	APIversion = "1.8.0"
 	ClientName = "subsonicfs"
+
+	// TokenAPIversion is the first API version supporting token
+	// authentication (t= and s= instead of p=).
+	TokenAPIversion = "1.13.0"
 )
 
 type Client struct {
-	urlfmt string
-	cli    *http.Client
+	baseurl string
+	user    string
+	passwd  string
+	apikey  string // OpenSubsonic API key; replaces user and password
+	cli     *http.Client
+
+	mu      sync.Mutex
+	version string // as reported by the server
+	token   bool   // use token authentication, until found unsupported
+	format  Format
+	xml     bool // use f=xml
+	retry   RetryPolicy
+
+	// set by SetLimits
+	calls   sem
+	streams sem
+	bucket  *bucket
 }
 
+// Format is the wire format of the API responses.
+type Format int
+
+const (
+	// FormatAuto uses JSON, switching to XML if the server returns
+	// JSON that cannot be parsed.
+	FormatAuto Format = iota
+	FormatJSON
+	FormatXML
+)
+
 func NewClient(host, user, password string, secure bool) *Client {
 	var t http.Transport
 	schema := "http"
 	if secure {
 		schema += "s"
-		tc := tls.Config{InsecureSkipVerify: true} // FIXME
-		t.TLSClientConfig = &tc
 	}
 	schema += "://"
-	u := fmt.Sprintf("%s%s/rest/%%s.view?f=json&u=%s&p=%s&v=%s&c=%s",
-		schema, host, user, password, APIversion, ClientName)
-	return &Client{u, &http.Client{Transport: &t}}
+	return &Client{
+		baseurl: schema + host + "/rest/",
+		user:    user,
+		passwd:  password,
+		token:   true,
+		cli:     &http.Client{Transport: &t},
+	}
 }
 
-type ReqError struct {
-	Code    int
-	Message string
+// NewAPIKeyClient returns a client authenticating with an OpenSubsonic
+// API key instead of username and password. Ping fails with
+// ErrAPIKeyUnsupported if the server does not advertise the
+// apiKeyAuthentication extension.
+func NewAPIKeyClient(host, key string, secure bool) *Client {
+	c := NewClient(host, "", "", secure)
+	c.apikey = key
+	return c
 }
 
-func (e ReqError) Error() string {
-	return e.Message
+// SetTLSConfig replaces the TLS configuration used to connect to the
+// server (see TLSConfig). It must be called before the client is used.
+func (c *Client) SetTLSConfig(tc *tls.Config) {
+	c.cli.Transport.(*http.Transport).TLSClientConfig = tc
+}
+
+// SetFormat sets the wire format of the API responses; the default is
+// FormatAuto.
+func (c *Client) SetFormat(f Format) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.format = f
+	c.xml = f == FormatXML
+}
+
+// ServerVersion returns the API version reported by the server on the
+// last Ping, or an empty string if the server has not been pinged yet.
+func (c *Client) ServerVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
 }
 
-func parsePingResp(data []byte) error {
-	var buf struct {
-		R struct {
-			Error *ReqError
-		} `json:"subsonic-response"`
+// reqURL returns the URL for the given API method. Authentication
+// parameters are added to a copy of q: token-based ones (with a fresh
+// salt), unless the server was found not to support them, hex-encoded
+// password otherwise.
+func (c *Client) reqURL(method string, q url.Values) string {
+	v := url.Values{}
+	for k, vv := range q {
+		v[k] = vv
 	}
-	if err := json.Unmarshal(data, &buf); err != nil {
-		return err
+	c.mu.Lock()
+	token := c.token
+	f := "json"
+	if c.xml {
+		f = "xml"
 	}
-	if buf.R.Error != nil {
-		return buf.R.Error
+	c.mu.Unlock()
+	v.Set("f", f)
+	v.Set("c", ClientName)
+	if c.apikey != "" {
+		v.Set("apiKey", c.apikey)
+		v.Set("v", APIversion)
+		return c.baseurl + method + ".view?" + v.Encode()
 	}
-	return nil
+	v.Set("u", c.user)
+	if token {
+		salt := newSalt()
+		v.Set("t", fmt.Sprintf("%x", md5.Sum([]byte(c.passwd+salt))))
+		v.Set("s", salt)
+		v.Set("v", TokenAPIversion)
+	} else {
+		v.Set("p", "enc:"+hex.EncodeToString([]byte(c.passwd)))
+		v.Set("v", APIversion)
+	}
+	return c.baseurl + method + ".view?" + v.Encode()
 }
 
-func (c *Client) Ping() error {
-	url := fmt.Sprintf(c.urlfmt, "ping")
-	resp, err := c.doReq(url)
-	if err != nil {
-		return err
+func newSalt() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
-	return parsePingResp(resp)
+	return hex.EncodeToString(b)
 }
 
-type Resource struct {
-	Id   int
-	Name string
+// versionAtLeast reports whether the dotted version string v is
+// greater than or equal to min. Missing components count as zero.
+func versionAtLeast(v, min string) bool {
+	a, b := strings.Split(v, "."), strings.Split(min, ".")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x, _ = strconv.Atoi(a[i])
+		}
+		if i < len(b) {
+			y, _ = strconv.Atoi(b[i])
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return true
+}
+
+// ReqError is an error reported by the server. It matches, with
+// errors.Is, the error of its code among the ones below.
+type ReqError struct {
+	Code    int    `xml:"code,attr"`
+	Message string `xml:"message,attr"`
+	HelpURL string `xml:"helpUrl,attr"` // OpenSubsonic only
+}
+
+func (e *ReqError) Error() string {
+	return e.Message
+}
+
+func (e *ReqError) Is(target error) bool {
+	err, ok := codeErrors[e.Code]
+	return ok && err == target
 }
 
-type Artist Resource
+// Errors of the codes documented by the Subsonic API.
+var (
+	ErrMissingParameter = errors.New("required parameter is missing")
+	ErrVersion          = errors.New("incompatible client and server versions")
+	ErrWrongCredentials = errors.New("wrong username or password")
+	ErrTokenUnsupported = errors.New("token authentication not supported")
+	ErrNotAuthorized    = errors.New("user is not authorized for the given operation")
+	ErrNotFound         = errors.New("requested data was not found")
+)
+
+var codeErrors = map[int]error{
+	10: ErrMissingParameter,
+	20: ErrVersion, // client must upgrade
+	30: ErrVersion, // server must upgrade
+	40: ErrWrongCredentials,
+	41: ErrTokenUnsupported,
+	50: ErrNotAuthorized,
+	70: ErrNotFound,
+}
+
+// response is the content of a "subsonic-response" envelope. It holds
+// the payload of every supported method; the ones not pertaining to the
+// decoded response are left empty.
+type response struct {
+	XMLName xml.Name  `xml:"subsonic-response" json:"-"`
+	Status  string    `xml:"status,attr"`
+	Version string    `xml:"version,attr"`
+	Error   *ReqError `xml:"error"`
+
+	OpenSubsonicExtensions list[Extension] `xml:"openSubsonicExtensions"`
+	Artists                struct {
+		Index list[indexEntry] `xml:"index"`
+	} `xml:"artists"`
+	Indexes struct {
+		LastModified num              `xml:"lastModified,attr"`
+		Index        list[indexEntry] `xml:"index"`
+	} `xml:"indexes"`
+	ScanStatus struct {
+		Scanning bool `xml:"scanning,attr"`
+		Count    num  `xml:"count,attr"`
+	} `xml:"scanStatus"`
+	Artist struct {
+		Album list[albumEntry] `xml:"album"`
+	} `xml:"artist"`
+	Album struct {
+		Song list[songEntry] `xml:"song"`
+	} `xml:"album"`
+}
 
-func parseArtistMap(m map[string]interface{}) (*Artist, error) {
-	var a Artist
-	v, ok := m["id"]
-	if !ok {
-		return nil, fmt.Errorf("field 'id' not found while decoding artist")
+// decode decodes a response, either JSON or XML, returning its error if
+// the request failed. The response is returned even in case of error,
+// so that fields like Version are still available.
+func decode(data []byte) (*response, error) {
+	var r response
+	if d := bytes.TrimSpace(data); len(d) > 0 && d[0] == '<' {
+		if err := xml.Unmarshal(d, &r); err != nil {
+			return nil, err
+		}
+	} else {
+		var buf struct {
+			R response `json:"subsonic-response"`
+		}
+		if err := json.Unmarshal(data, &buf); err != nil {
+			return nil, err
+		}
+		r = buf.R
+	}
+	if r.Error != nil {
+		return &r, r.Error
+	}
+	return &r, nil
+}
+
+// list is a JSON array which the server encodes as a single object
+// when it holds only one element.
+type list[T any] []T
+
+func (l *list[T]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*l = nil
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var v []T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*l = v
+		return nil
+	default:
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*l = list[T]{v}
+		return nil
+	}
+}
+
+// text is a string that may be encoded as a JSON number (e.g. an
+// album called 1979) or contain HTML entities.
+type text string
+
+func (t *text) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
 	}
 	switch vv := v.(type) {
+	case nil:
+		*t = ""
+	case string:
+		*t = text(html.UnescapeString(vv))
 	case float64:
-		a.Id = int(vv)
+		*t = text(fmt.Sprintf("%v", vv))
 	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding artist: expecting float64", vv)
+		return fmt.Errorf("unexpected type (%T): expecting string or float64", vv)
 	}
+	return nil
+}
 
-	v, ok = m["name"]
-	if !ok {
-		return nil, fmt.Errorf("field 'name' not found while decoding artist")
+func (t *text) UnmarshalXMLAttr(attr xml.Attr) error {
+	*t = text(html.UnescapeString(attr.Value))
+	return nil
+}
+
+// ident is a resource identifier, either a string or a JSON number.
+type ident string
+
+func (id *ident) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
 	}
 	switch vv := v.(type) {
+	case nil:
+		*id = ""
 	case string:
-		a.Name = html.UnescapeString(vv)
+		*id = ident(vv)
 	case float64:
-		a.Name = fmt.Sprintf("%v", vv)
+		*id = ident(strconv.FormatFloat(vv, 'f', -1, 64))
 	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding artist: expecting string or float64", vv)
+		return fmt.Errorf("unexpected type (%T) for field 'id': expecting string or float64", vv)
 	}
-	return &a, nil
+	return nil
 }
 
-func parseIndexMap(m map[string]interface{}) ([]Artist, error) {
-	a, ok := m["artist"]
-	if !ok {
-		return nil, fmt.Errorf("field 'artist' not found while decoding index entry")
+// num is an integer that may be encoded as a JSON string.
+type num int64
+
+func (n *num) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
 	}
-	var retv []Artist
-	switch aa := a.(type) {
-	case map[string]interface{}:
-		tmp, err := parseArtistMap(aa)
+	switch vv := v.(type) {
+	case nil:
+		*n = 0
+	case float64:
+		*n = num(vv)
+	case string:
+		if vv == "" {
+			*n = 0
+			return nil
+		}
+		f, err := strconv.ParseFloat(vv, 64)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("invalid number %q", vv)
 		}
-		retv = append(retv, *tmp)
-
-	case []interface{}:
-		for _, v := range aa {
-			switch vv := v.(type) {
-			case map[string]interface{}:
-				tmp, err := parseArtistMap(vv)
-				if err != nil {
-					return nil, err
-				}
-				retv = append(retv, *tmp)
-
-			default:
-				return nil, fmt.Errorf("unexpected type (%T) while decoding artist array: expecting map[string]interface{}", vv)
-			}
+		*n = num(f)
+	default:
+		return fmt.Errorf("unexpected type (%T): expecting float64 or string", vv)
+	}
+	return nil
+}
+
+// timestamp is a point in time. Subsonic omits the time zone, meaning
+// UTC; OpenSubsonic servers use RFC 3339.
+type timestamp time.Time
+
+func (t *timestamp) UnmarshalText(data []byte) error {
+	s := string(data)
+	if s == "" {
+		*t = timestamp{}
+		return nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if v, err := time.Parse(layout, s); err == nil {
+			*t = timestamp(v)
+			return nil
 		}
+	}
+	return fmt.Errorf("invalid timestamp %q", s)
+}
 
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding index entry: expecting map[string]interface{} or []interface{}", aa)
+func parsePingResp(data []byte) (string, error) {
+	r, err := decode(data)
+	if r == nil {
+		return "", err
 	}
-	return retv, nil
+	return r.Version, err
 }
 
-func parseGetArtistsResp(data []byte) ([]Artist, error) {
-	var buf struct {
-		R struct {
-			Error   *ReqError
-			Artists struct {
-				Index interface{}
-			}
-		} `json:"subsonic-response"`
+// Ping checks the connection with the server and records the API
+// version it reports. Token authentication is tried first, switching to
+// the hex-encoded password if the server does not support it.
+func (c *Client) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is like Ping but with a context.
+func (c *Client) PingContext(ctx context.Context) error {
+	if c.apikey != "" {
+		if err := c.checkAPIKeySupport(ctx); err != nil {
+			return err
+		}
+	}
+	resp, err := c.doReq(ctx, "ping", nil)
+	if err != nil {
+		return err
 	}
-	if err := json.Unmarshal(data, &buf); err != nil {
+	version, err := parsePingResp(resp)
+	if version != "" {
+		c.mu.Lock()
+		c.version = version
+		if !versionAtLeast(version, TokenAPIversion) {
+			c.token = false
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// ErrAPIKeyUnsupported is returned by Ping when the client uses API key
+// authentication and the server does not support it.
+var ErrAPIKeyUnsupported = errors.New("server does not support API key authentication")
+
+// Extension is an OpenSubsonic extension supported by the server.
+type Extension struct {
+	Name     string `xml:"name,attr"`
+	Versions []int  `xml:"versions"`
+}
+
+func parseGetOpenSubsonicExtensionsResp(data []byte) ([]Extension, error) {
+	r, err := decode(data)
+	if err != nil {
 		return nil, err
 	}
-	if buf.R.Error != nil {
-		return nil, buf.R.Error
+	return r.OpenSubsonicExtensions, nil
+}
+
+// GetOpenSubsonicExtensions returns the OpenSubsonic extensions
+// supported by the server. Classic Subsonic servers return an error.
+func (c *Client) GetOpenSubsonicExtensions() ([]Extension, error) {
+	return c.GetOpenSubsonicExtensionsContext(context.Background())
+}
+
+// GetOpenSubsonicExtensionsContext is like GetOpenSubsonicExtensions
+// but with a context.
+func (c *Client) GetOpenSubsonicExtensionsContext(ctx context.Context) ([]Extension, error) {
+	resp, err := c.doReq(ctx, "getOpenSubsonicExtensions", nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseGetOpenSubsonicExtensionsResp(resp)
+}
+
+func (c *Client) checkAPIKeySupport(ctx context.Context) error {
+	exts, err := c.GetOpenSubsonicExtensionsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: getOpenSubsonicExtensions: %v", ErrAPIKeyUnsupported, err)
+	}
+	for _, e := range exts {
+		if e.Name == "apiKeyAuthentication" {
+			return nil
+		}
+	}
+	return ErrAPIKeyUnsupported
+}
+
+// Resource is a server object. Ids are opaque strings: classic
+// Subsonic servers use numbers, OpenSubsonic ones (e.g. Navidrome) may
+// use anything.
+type Resource struct {
+	Id   string
+	Name string
+}
+
+// Artist is an artist of the library, along with the name of the index
+// the server lists it under.
+type Artist struct {
+	Resource
+	Index      string
+	AlbumCount int
+}
+
+type indexEntry struct {
+	Name   text              `xml:"name,attr"`
+	Artist list[artistEntry] `xml:"artist"`
+}
+
+type artistEntry struct {
+	Id         ident `xml:"id,attr"`
+	Name       text  `xml:"name,attr"`
+	AlbumCount num   `xml:"albumCount,attr"`
+}
+
+func (e *artistEntry) artist(index string) (Artist, error) {
+	if e.Id == "" {
+		return Artist{}, fmt.Errorf("field 'id' not found while decoding artist")
+	}
+	return Artist{
+		Resource:   Resource{string(e.Id), string(e.Name)},
+		Index:      index,
+		AlbumCount: int(e.AlbumCount),
+	}, nil
+}
+
+func parseGetArtistsResp(data []byte) ([]Artist, error) {
+	r, err := decode(data)
+	if err != nil {
+		return nil, err
 	}
 	var retv []Artist
-	switch index := buf.R.Artists.Index.(type) {
-	case map[string]interface{}:
-		return parseIndexMap(index)
-
-	case []interface{}:
-		for _, v := range index {
-			switch vv := v.(type) {
-			case map[string]interface{}:
-				tmp, err := parseIndexMap(vv)
-				if err != nil {
-					return nil, err
-				}
-				retv = append(retv, tmp...)
-
-			default:
-				return nil, fmt.Errorf("unexpected type (%T) while decoding index array: expecting map[string]interface{}", vv)
+	for _, index := range r.Artists.Index {
+		for _, e := range index.Artist {
+			a, err := e.artist(string(index.Name))
+			if err != nil {
+				return nil, err
 			}
+			retv = append(retv, a)
 		}
-
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding index: expecting []interface{} or map[string]interface{}", index)
 	}
 	return retv, nil
 }
+
 func (c *Client) GetArtists() ([]Artist, error) {
-	url := fmt.Sprintf(c.urlfmt, "getArtists")
-	resp, err := c.doReq(url)
+	return c.GetArtistsContext(context.Background())
+}
+
+// GetArtistsContext is like GetArtists but with a context.
+func (c *Client) GetArtistsContext(ctx context.Context) ([]Artist, error) {
+	resp, err := c.doReq(ctx, "getArtists", nil)
 	if err != nil {
 		return nil, err
 	}
 	return parseGetArtistsResp(resp)
 }
 
-type Album Resource
+// Indexes is the folder based index of the library.
+type Indexes struct {
+	LastModified time.Time
+	Artists      []Artist // empty if not modified
+}
 
-func parseAlbumMap(m map[string]interface{}) (*Album, error) {
-	var a Album
-	v, ok := m["id"]
-	if !ok {
-		return nil, fmt.Errorf("field 'id' not found while decoding album")
+func parseGetIndexesResp(data []byte) (*Indexes, error) {
+	r, err := decode(data)
+	if err != nil {
+		return nil, err
 	}
-	switch vv := v.(type) {
-	case float64:
-		a.Id = int(vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding album: expecting float64", vv)
+	retv := &Indexes{}
+	if ms := int64(r.Indexes.LastModified); ms > 0 {
+		retv.LastModified = time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
 	}
+	for _, index := range r.Indexes.Index {
+		for _, e := range index.Artist {
+			a, err := e.artist(string(index.Name))
+			if err != nil {
+				return nil, err
+			}
+			retv.Artists = append(retv.Artists, a)
+		}
+	}
+	return retv, nil
+}
 
-	v, ok = m["name"]
-	if !ok {
-		return nil, fmt.Errorf("field 'name' not found while decoding album")
+// GetIndexes returns the folder based index of the library, if modified
+// after since. The artists are omitted otherwise, making it a cheap way
+// to check the library for changes. Their ids are the ones of the music
+// folders, not of the artists returned by GetArtists.
+func (c *Client) GetIndexes(since time.Time) (*Indexes, error) {
+	return c.GetIndexesContext(context.Background(), since)
+}
+
+// GetIndexesContext is like GetIndexes but with a context.
+func (c *Client) GetIndexesContext(ctx context.Context, since time.Time) (*Indexes, error) {
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("ifModifiedSince", strconv.FormatInt(since.UnixNano()/int64(time.Millisecond), 10))
 	}
-	switch vv := v.(type) {
-	case string:
-		a.Name = html.UnescapeString(vv)
-	case float64:
-		a.Name = fmt.Sprintf("%v", vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding album: expecting string or float64", vv)
+	resp, err := c.doReq(ctx, "getIndexes", q)
+	if err != nil {
+		return nil, err
 	}
-	return &a, nil
+	return parseGetIndexesResp(resp)
 }
 
-func parseGetArtistResp(data []byte) ([]Album, error) {
-	var buf struct {
-		R struct {
-			Error  *ReqError
-			Artist struct {
-				Album interface{}
-			}
-		} `json:"subsonic-response"`
+// ScanStatus is the state of the media library scan of the server.
+type ScanStatus struct {
+	Scanning bool
+	Count    int64 // files scanned so far
+}
+
+func parseGetScanStatusResp(data []byte) (ScanStatus, error) {
+	r, err := decode(data)
+	if err != nil {
+		return ScanStatus{}, err
 	}
-	if err := json.Unmarshal(data, &buf); err != nil {
-		return nil, err
+	return ScanStatus{r.ScanStatus.Scanning, int64(r.ScanStatus.Count)}, nil
+}
+
+// GetScanStatus returns the state of the media library scan. It needs
+// API version 1.15.0.
+func (c *Client) GetScanStatus() (ScanStatus, error) {
+	return c.GetScanStatusContext(context.Background())
+}
+
+// GetScanStatusContext is like GetScanStatus but with a context.
+func (c *Client) GetScanStatusContext(ctx context.Context) (ScanStatus, error) {
+	resp, err := c.doReq(ctx, "getScanStatus", nil)
+	if err != nil {
+		return ScanStatus{}, err
 	}
-	if buf.R.Error != nil {
-		return nil, buf.R.Error
+	return parseGetScanStatusResp(resp)
+}
+
+// Album is an album of an artist. Fields not sent by the server are
+// left zero.
+type Album struct {
+	Resource
+	Artist    string
+	ArtistId  string
+	Year      int
+	Genre     string
+	SongCount int
+	Duration  time.Duration
+	Created   time.Time
+	CoverArt  string
+}
+
+type albumEntry struct {
+	Id        ident     `xml:"id,attr"`
+	Name      text      `xml:"name,attr"`
+	Artist    text      `xml:"artist,attr"`
+	ArtistId  ident     `xml:"artistId,attr"`
+	Year      num       `xml:"year,attr"`
+	Genre     text      `xml:"genre,attr"`
+	SongCount num       `xml:"songCount,attr"`
+	Duration  num       `xml:"duration,attr"`
+	Created   timestamp `xml:"created,attr"`
+	CoverArt  ident     `xml:"coverArt,attr"`
+}
+
+func (e *albumEntry) album() (Album, error) {
+	if e.Id == "" {
+		return Album{}, fmt.Errorf("field 'id' not found while decoding album")
+	}
+	return Album{
+		Resource:  Resource{string(e.Id), string(e.Name)},
+		Artist:    string(e.Artist),
+		ArtistId:  string(e.ArtistId),
+		Year:      int(e.Year),
+		Genre:     string(e.Genre),
+		SongCount: int(e.SongCount),
+		Duration:  time.Duration(e.Duration) * time.Second,
+		Created:   time.Time(e.Created),
+		CoverArt:  string(e.CoverArt),
+	}, nil
+}
+
+func parseGetArtistResp(data []byte) ([]Album, error) {
+	r, err := decode(data)
+	if err != nil {
+		return nil, err
 	}
 	var retv []Album
-	switch a := buf.R.Artist.Album.(type) {
-	case map[string]interface{}:
-		tmp, err := parseAlbumMap(a)
+	for _, e := range r.Artist.Album {
+		a, err := e.album()
 		if err != nil {
 			return nil, err
 		}
-		retv = append(retv, *tmp)
-
-	case []interface{}:
-		for _, v := range a {
-			switch vv := v.(type) {
-			case map[string]interface{}:
-				tmp, err := parseAlbumMap(vv)
-				if err != nil {
-					return nil, err
-				}
-				retv = append(retv, *tmp)
-
-			default:
-				return nil, fmt.Errorf("unexpected type (%T) while decoding album array: expecting map[string]interface{}", vv)
-			}
-		}
-
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding artist entry: expecting map[string]interface{} or []interface{}", a)
+		retv = append(retv, a)
 	}
 	return retv, nil
 }
 
-func (c *Client) GetArtist(artist int) ([]Album, error) {
-	url := fmt.Sprintf(c.urlfmt+"&id=%d", "getArtist", artist)
-	resp, err := c.doReq(url)
+func (c *Client) GetArtist(artist string) ([]Album, error) {
+	return c.GetArtistContext(context.Background(), artist)
+}
+
+// GetArtistContext is like GetArtist but with a context.
+func (c *Client) GetArtistContext(ctx context.Context, artist string) ([]Album, error) {
+	q := url.Values{"id": {artist}}
+	resp, err := c.doReq(ctx, "getArtist", q)
 	if err != nil {
 		return nil, err
 	}
 	return parseGetArtistResp(resp)
 }
 
+// Song is a song of an album. Fields not sent by the server are left
+// zero.
 type Song struct {
 	Resource
-	Number int
-	Suffix string
+	Number      int
+	Suffix      string
+	DiscNumber  int
+	Duration    time.Duration
+	Size        int64
+	BitRate     int // kbps
+	ContentType string
+	Year        int
+	Genre       string
+	Artist      string
+	ArtistId    string
+	Album       string
+	AlbumId     string
+	Created     time.Time
+	PlayCount   int64
+	Path        string
+	CoverArt    string
+	ReplayGain  ReplayGain
 }
 
-func parseSongMap(m map[string]interface{}) (*Song, error) {
-	var s Song
-	v, ok := m["id"]
-	if !ok {
-		return nil, fmt.Errorf("field 'id' not found while decoding song")
-	}
-	switch vv := v.(type) {
-	case float64:
-		s.Id = int(vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding song: expecting float64", vv)
-	}
-
-	v, ok = m["title"]
-	if !ok {
-		return nil, fmt.Errorf("field 'title' not found while decoding song")
-	}
-	switch vv := v.(type) {
-	case string:
-		s.Name = html.UnescapeString(vv)
-	case float64:
-		s.Name = fmt.Sprintf("%v", vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding song: expecting string", vv)
-	}
+// ReplayGain holds the replay gain values of a song, in dB (gains) and
+// as a fraction of full scale (peaks). Only OpenSubsonic servers send
+// them.
+type ReplayGain struct {
+	TrackGain    float64 `xml:"trackGain,attr"`
+	AlbumGain    float64 `xml:"albumGain,attr"`
+	TrackPeak    float64 `xml:"trackPeak,attr"`
+	AlbumPeak    float64 `xml:"albumPeak,attr"`
+	BaseGain     float64 `xml:"baseGain,attr"`
+	FallbackGain float64 `xml:"fallbackGain,attr"`
+}
 
-	v, ok = m["track"]
-	if !ok {
-		return nil, fmt.Errorf("field 'track' not found while decoding song")
-	}
-	switch vv := v.(type) {
-	case float64:
-		s.Number = int(vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding album: expecting float64", vv)
-	}
+type songEntry struct {
+	Id          ident      `xml:"id,attr"`
+	Title       text       `xml:"title,attr"`
+	Track       num        `xml:"track,attr"`
+	Suffix      text       `xml:"suffix,attr"`
+	DiscNumber  num        `xml:"discNumber,attr"`
+	Duration    num        `xml:"duration,attr"`
+	Size        num        `xml:"size,attr"`
+	BitRate     num        `xml:"bitRate,attr"`
+	ContentType text       `xml:"contentType,attr"`
+	Year        num        `xml:"year,attr"`
+	Genre       text       `xml:"genre,attr"`
+	Artist      text       `xml:"artist,attr"`
+	ArtistId    ident      `xml:"artistId,attr"`
+	Album       text       `xml:"album,attr"`
+	AlbumId     ident      `xml:"albumId,attr"`
+	Created     timestamp  `xml:"created,attr"`
+	PlayCount   num        `xml:"playCount,attr"`
+	Path        text       `xml:"path,attr"`
+	CoverArt    ident      `xml:"coverArt,attr"`
+	ReplayGain  ReplayGain `xml:"replayGain"`
+}
 
-	v, ok = m["suffix"]
-	if !ok {
-		return nil, fmt.Errorf("field 'suffix' not found while decoding song")
+func (e *songEntry) song() (Song, error) {
+	if e.Id == "" {
+		return Song{}, fmt.Errorf("field 'id' not found while decoding song")
 	}
-	switch vv := v.(type) {
-	case string:
-		s.Suffix = html.UnescapeString(vv)
-	case float64:
-		s.Suffix = fmt.Sprintf("%v", vv)
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding album: expecting string or float64", vv)
-	}
-	return &s, nil
+	return Song{
+		Resource:    Resource{string(e.Id), string(e.Title)},
+		Number:      int(e.Track),
+		Suffix:      string(e.Suffix),
+		DiscNumber:  int(e.DiscNumber),
+		Duration:    time.Duration(e.Duration) * time.Second,
+		Size:        int64(e.Size),
+		BitRate:     int(e.BitRate),
+		ContentType: string(e.ContentType),
+		Year:        int(e.Year),
+		Genre:       string(e.Genre),
+		Artist:      string(e.Artist),
+		ArtistId:    string(e.ArtistId),
+		Album:       string(e.Album),
+		AlbumId:     string(e.AlbumId),
+		Created:     time.Time(e.Created),
+		PlayCount:   int64(e.PlayCount),
+		Path:        string(e.Path),
+		CoverArt:    string(e.CoverArt),
+		ReplayGain:  e.ReplayGain,
+	}, nil
 }
 
 func parseGetAlbumResp(data []byte) ([]Song, error) {
-	var buf struct {
-		R struct {
-			Error *ReqError
-			Album struct {
-				Song interface{}
-			}
-		} `json:"subsonic-response"`
-	}
-	if buf.R.Error != nil {
-		return nil, buf.R.Error
-	}
-	if err := json.Unmarshal(data, &buf); err != nil {
+	r, err := decode(data)
+	if err != nil {
 		return nil, err
 	}
 	var retv []Song
-	switch s := buf.R.Album.Song.(type) {
-	case map[string]interface{}:
-		tmp, err := parseSongMap(s)
+	for _, e := range r.Album.Song {
+		s, err := e.song()
 		if err != nil {
 			return nil, err
 		}
-		retv = append(retv, *tmp)
-
-	case []interface{}:
-		for _, v := range s {
-			switch vv := v.(type) {
-			case map[string]interface{}:
-				tmp, err := parseSongMap(vv)
-				if err != nil {
-					return nil, err
-				}
-				retv = append(retv, *tmp)
-
-			default:
-				return nil, fmt.Errorf("unexpected type (%T) while decoding song array: expecting map[string]interface{}", vv)
-			}
-		}
-	default:
-		return nil, fmt.Errorf("unexpected type (%T) while decoding album entry: expecting map[string]interface{} or []interface{}", s)
+		retv = append(retv, s)
 	}
 	return retv, nil
+}
 
+func (c *Client) GetAlbum(album string) ([]Song, error) {
+	return c.GetAlbumContext(context.Background(), album)
 }
 
-func (c *Client) GetAlbum(album int) ([]Song, error) {
-	url := fmt.Sprintf(c.urlfmt+"&id=%d", "getAlbum", album)
-	resp, err := c.doReq(url)
+// GetAlbumContext is like GetAlbum but with a context.
+func (c *Client) GetAlbumContext(ctx context.Context, album string) ([]Song, error) {
+	q := url.Values{"id": {album}}
+	resp, err := c.doReq(ctx, "getAlbum", q)
 	if err != nil {
 		return nil, err
 	}
 	return parseGetAlbumResp(resp)
 }
 
-func (c *Client) Stream(song, maxbitrate int) (io.ReadCloser, error) {
-	url := fmt.Sprintf(c.urlfmt+"&id=%d&maxBitRate=%d", "stream", song, maxbitrate)
-	resp, err := c.cli.Get(url)
+func (c *Client) Stream(song string, maxbitrate int) (io.ReadCloser, error) {
+	return c.StreamContext(context.Background(), song, maxbitrate)
+}
+
+// StreamContext is like Stream but with a context. Cancelling the
+// context aborts the transfer: reads from the returned stream fail.
+func (c *Client) StreamContext(ctx context.Context, song string, maxbitrate int) (io.ReadCloser, error) {
+	t, err := c.StreamAtContext(ctx, song, maxbitrate, 0)
 	if err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
+	return t, nil
+}
+
+// Transfer is a song being downloaded.
+type Transfer struct {
+	io.ReadCloser
+	// Size is the size of the whole song as reported by the server, or
+	// -1 if unknown, as when transcoding. No estimate is asked: the
+	// transport would take it for the length of the transfer,
+	// truncating it or failing at its end.
+	Size int64
+}
+
+// StreamAtContext is like StreamContext, but the returned stream starts
+// at the given byte offset. The server is sent a Range request; if it
+// ignores it, as it may when transcoding, the leading bytes are
+// skipped. An offset past the end of the song yields an empty stream.
+func (c *Client) StreamAtContext(ctx context.Context, song string, maxbitrate int, offset int64) (*Transfer, error) {
+	q := url.Values{
+		"id":         {song},
+		"maxBitRate": {strconv.Itoa(maxbitrate)},
+	}
+	return c.open(ctx, "stream", c.reqURL("stream", q), offset, false)
+}
+
+// TryStreamAtContext is like StreamAtContext, for transfers which can be
+// done later, such as downloads ahead of time: it fails with ErrBusy
+// instead of waiting when the stream limit is reached, and it never
+// takes the last stream, leaving it to the other transfers.
+func (c *Client) TryStreamAtContext(ctx context.Context, song string, maxbitrate int, offset int64) (*Transfer, error) {
+	q := url.Values{
+		"id":         {song},
+		"maxBitRate": {strconv.Itoa(maxbitrate)},
+	}
+	return c.open(ctx, "stream", c.reqURL("stream", q), offset, true)
+}
+
+// DownloadAtContext returns the original file of a song, without
+// transcoding, starting at the given byte offset (see StreamAtContext).
+func (c *Client) DownloadAtContext(ctx context.Context, song string, offset int64) (*Transfer, error) {
+	return c.open(ctx, "download", c.reqURL("download", url.Values{"id": {song}}), offset, false)
+}
+
+// open opens the transfer of method at u, taking a spare stream if
+// spare (see stream).
+func (c *Client) open(ctx context.Context, method, u string, offset int64, spare bool) (*Transfer, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	release, err := c.stream(ctx, spare)
+	switch {
+	case err == ErrBusy:
+		return nil, err
+	case err != nil:
+		return nil, newCallError(KindNetwork, method, u, 0, err)
+	}
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		release()
+		return nil, newCallError(KindNetwork, method, u, 0, err)
+	}
+	resp.Body = &releaser{ReadCloser: resp.Body, release: release}
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return &Transfer{ioutil.NopCloser(strings.NewReader("")), rangeSize(resp)}, nil
+	}
+	if err := streamError(method, u, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return &Transfer{resp.Body, rangeSize(resp)}, nil
+	case offset == 0:
+		return &Transfer{resp.Body, resp.ContentLength}, nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil && err != io.EOF {
+		resp.Body.Close()
+		return nil, newCallError(KindNetwork, method, u, resp.StatusCode, err)
+	}
+	return &Transfer{resp.Body, resp.ContentLength}, nil
+}
+
+// streamError returns the error sent by the server in resp, the call of
+// method at u, instead of a song: a subsonic-response, recognized by its
+// content type, or any response with a status other than 2xx.
+func streamError(method, u string, resp *http.Response) error {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	doc := mt == "text/xml" || mt == "application/xml" || mt == "application/json"
+	ok := resp.StatusCode/100 == 2
+	if ok && !doc && mt != "text/html" {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return newCallError(KindNetwork, method, u, resp.StatusCode, err)
+	}
+	if _, err := decode(data); err != nil {
+		if e, isReq := err.(*ReqError); isReq {
+			return e
+		}
+	}
+	switch {
+	case isHTML(resp, data):
+		return newCallError(KindHTML, method, u, resp.StatusCode, nil)
+	case !ok:
+		return newCallError(KindStatus, method, u, resp.StatusCode, nil)
+	}
+	return newCallError(KindMalformed, method, u, resp.StatusCode,
+		fmt.Errorf("%s instead of a song", mt))
+}
+
+// rangeSize returns the complete length from the Content-Range header
+// of resp, or -1.
+func rangeSize(resp *http.Response) int64 {
+	cr := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(cr, '/')
+	if i < 0 {
+		return -1
+	}
+	n, err := strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
 }
@@ -1,8 +1,21 @@
 package subsonic
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -35,16 +48,20 @@ func TestPing(t *testing.T) {
 	if err := json.Unmarshal(j, &buf); err != nil {
 		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
 	}
-	if err := parsePingResp(j); err != nil {
+	v, err := parsePingResp(j)
+	if err != nil {
 		t.Error("unexpected error:", err)
 	}
+	if v != "1.8.0" {
+		t.Error(v, "≠", "1.8.0")
+	}
 
 	// error case:
 	j = []byte(Jhead + Jerr + "," + Jtail)
 	if err := json.Unmarshal(j, &buf); err != nil {
 		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
 	}
-	if err := parsePingResp(j); err != nil {
+	if _, err := parsePingResp(j); err != nil {
 		if err.Error() != errMsg {
 			t.Error("unexpected error:", err)
 		}
@@ -53,6 +70,202 @@ func TestPing(t *testing.T) {
 	}
 }
 
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v, min string
+		ok     bool
+	}{
+		{"1.8.0", "1.13.0", false},
+		{"1.13.0", "1.13.0", true},
+		{"1.16.1", "1.13.0", true},
+		{"1.13", "1.13.0", true},
+		{"2.0.0", "1.13.0", true},
+		{"", "1.13.0", false},
+	}
+	for _, tt := range tests {
+		if ok := versionAtLeast(tt.v, tt.min); ok != tt.ok {
+			t.Error(tt.v, ">=", tt.min, ":", ok, "≠", tt.ok)
+		}
+	}
+}
+
+func TestAuthParams(t *testing.T) {
+	c := NewClient("localhost", "bob", "sesame", false)
+
+	// a salted token, by default:
+	u, err := url.Parse(c.reqURL("ping", url.Values{"id": {"1"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("p") != "" {
+		t.Error("password leaked in URL:", u)
+	}
+	if strings.Contains(u.String(), "sesame") {
+		t.Error("password leaked in URL:", u)
+	}
+	s := q.Get("s")
+	if s == "" {
+		t.Fatal("missing salt")
+	}
+	if tok, want := q.Get("t"), fmt.Sprintf("%x", md5.Sum([]byte("sesame"+s))); tok != want {
+		t.Error(tok, "≠", want)
+	}
+	if q.Get("id") != "1" {
+		t.Error("lost query parameter:", u)
+	}
+	u2, _ := url.Parse(c.reqURL("ping", nil))
+	if u2.Query().Get("s") == s {
+		t.Error("salt reused across requests")
+	}
+
+	// the hex-encoded password, once tokens are found unsupported:
+	c.token = false
+	u, err = url.Parse(c.reqURL("ping", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = u.Query()
+	if p := q.Get("p"); p != "enc:736573616d65" {
+		t.Error(p, "≠", "enc:736573616d65")
+	}
+	if q.Get("t") != "" || q.Get("s") != "" {
+		t.Error("unexpected token parameters:", u)
+	}
+}
+
+func TestTokenFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string // reported by the server
+		code    int    // sent for tokens, if not 0
+		passwd  bool   // password sent after the first ping
+		ok      bool
+	}{
+		{"tokens", "1.16.1", 0, false, true},
+		{"legacy server", "1.12.0", 30, true, true},
+		{"legacy version", "1.12.0", 0, true, true},
+		{"LDAP account", "1.16.1", 41, true, true},
+		{"wrong password", "1.16.1", 40, false, false},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var auth []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			mu.Lock()
+			auth = append(auth, q.Get("p"))
+			mu.Unlock()
+			if q.Get("t") != "" && tt.code != 0 {
+				fmt.Fprintf(w, `{"subsonic-response":{"status":"failed","version":%q,"error":{"code":%d,"message":"no"}}}`, tt.version, tt.code)
+				return
+			}
+			fmt.Fprintf(w, `{"subsonic-response":{"status":"ok","version":%q}}`, tt.version)
+		}))
+		c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+		err := c.Ping()
+		c.Ping()
+		ts.Close()
+		if (err == nil) != tt.ok {
+			t.Error(tt.name, ": unexpected error:", err)
+		}
+		if auth[0] != "" {
+			t.Error(tt.name, ": password sent on the first ping")
+		}
+		if last := auth[len(auth)-1]; (last != "") != tt.passwd {
+			t.Error(tt.name, ": password sent:", last)
+		}
+		if tt.code != 0 && tt.passwd && len(auth) != 3 {
+			t.Error(tt.name, ":", len(auth), "calls ≠", 3)
+		}
+	}
+}
+
+func TestAPIKeyParams(t *testing.T) {
+	c := NewAPIKeyClient("localhost", "s3cr3t", false)
+	u, err := url.Parse(c.reqURL("ping", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if k := q.Get("apiKey"); k != "s3cr3t" {
+		t.Error(k, "≠", "s3cr3t")
+	}
+	for _, k := range []string{"u", "p", "t", "s"} {
+		if _, ok := q[k]; ok {
+			t.Error("unexpected parameter", k, "in", u)
+		}
+	}
+}
+
+func TestGetOpenSubsonicExtensions(t *testing.T) {
+	d := `
+ "openSubsonic": true,
+ "openSubsonicExtensions": [
+  {
+   "name": "transcodeOffset",
+   "versions": [1]
+  },
+  {
+   "name": "apiKeyAuthentication",
+   "versions": [1]
+  }
+ ]`
+	j := []byte(Jhead + d + "," + Jtail)
+	if err := json.Unmarshal(j, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	e, err := parseGetOpenSubsonicExtensionsResp(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 2 {
+		t.Fatal(len(e), "≠", 2)
+	}
+	if e[1].Name != "apiKeyAuthentication" || len(e[1].Versions) != 1 || e[1].Versions[0] != 1 {
+		t.Error("unexpected extension:", e[1])
+	}
+
+	// error case:
+	j = []byte(Jhead + Jerr + "," + Jtail)
+	if _, err := parseGetOpenSubsonicExtensionsResp(j); err == nil {
+		t.Error("expected error found nil")
+	}
+}
+
+func TestAPIKeyUnsupported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/getOpenSubsonicExtensions.view") {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, Jhead+Jtail)
+	}))
+	defer srv.Close()
+	c := NewAPIKeyClient(strings.TrimPrefix(srv.URL, "http://"), "s3cr3t", false)
+	if err := c.Ping(); !errors.Is(err, ErrAPIKeyUnsupported) {
+		t.Error("expected", ErrAPIKeyUnsupported, "found", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select { // stalled server
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), "bob", "sesame", false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetArtistsContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected", context.DeadlineExceeded, "found", err)
+	}
+}
+
 func TestGetArtists(t *testing.T) {
 	// common case:
 	names := []string{"A1", "A2", "Kwyjibo"}
@@ -96,13 +309,23 @@ func TestGetArtists(t *testing.T) {
 		t.Fatal(len(s), "≠", len(names))
 	}
 	for i, a := range s {
-		if a.Id != i {
+		if a.Id != strconv.Itoa(i) {
 			t.Error(a.Id, "≠", i)
 		}
 		if a.Name != s[i].Name {
 			t.Error(a.Name, "≠", names[i])
 		}
 	}
+	for i, index := range []string{"A", "A", "K"} {
+		if s[i].Index != index {
+			t.Error(s[i].Index, "≠", index)
+		}
+	}
+	for i, n := range []int{7, 1, 14} {
+		if s[i].AlbumCount != n {
+			t.Error(s[i].AlbumCount, "≠", n)
+		}
+	}
 
 	// numbers in name:
 	names = []string{"42", "0.12", "3.14"}
@@ -142,7 +365,7 @@ func TestGetArtists(t *testing.T) {
 		t.Fatal(len(s), "≠", len(names))
 	}
 	for i, a := range s {
-		if a.Id != i {
+		if a.Id != strconv.Itoa(i) {
 			t.Error(a.Id, "≠", i)
 		}
 		if a.Name != s[i].Name {
@@ -176,6 +399,39 @@ func TestGetArtists(t *testing.T) {
 		t.Error(s[0].Name, "≠", name)
 	}
 
+	// string ids (OpenSubsonic):
+	ids := []string{"2VSxJwFLjwZ8PPbhSXqQYC", "0bJ1mqWnnoADi6dwylvbYu"}
+	d = `
+ "artists": {"index": {
+   "name": "N",
+   "artist": [
+    {
+     "id": "` + ids[0] + `",
+     "name": "Nirvana"
+    },
+    {
+     "id": "` + ids[1] + `",
+     "name": "Nick Cave"
+    }
+   ]
+ }}`
+	j = []byte(Jhead + d + "," + Jtail)
+	if err := json.Unmarshal(j, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err = parseGetArtistsResp(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(ids) {
+		t.Fatal(len(s), "≠", len(ids))
+	}
+	for i, a := range s {
+		if a.Id != ids[i] {
+			t.Error(a.Id, "≠", ids[i])
+		}
+	}
+
 	// error case:
 	j = []byte(Jhead + Jerr + "," + Jtail)
 	if err := json.Unmarshal(j, &buf); err != nil {
@@ -190,6 +446,89 @@ func TestGetArtists(t *testing.T) {
 	}
 }
 
+func TestGetIndexes(t *testing.T) {
+	// modified:
+	d := `
+ "indexes": {
+  "lastModified": 1237646084000,
+  "ignoredArticles": "The El La Los Las Le Les",
+  "shortcut": {"id": "11", "name": "Audio books"},
+  "index": [
+   {"name": "A", "artist": [{"id": "1", "name": "ABBA"}, {"id": "2", "name": "Alanis Morisette"}]},
+   {"name": "B", "artist": {"id": "3", "name": "Bob Dylan"}}
+  ],
+  "child": {"id": "111", "parent": "11", "title": "Dancing Queen", "isDir": false}
+ }`
+	j := []byte(Jhead + d + "," + Jtail)
+	if err := json.Unmarshal(j, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	ix, err := parseGetIndexesResp(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm := time.Unix(1237646084, 0); !ix.LastModified.Equal(tm) {
+		t.Error(ix.LastModified, "≠", tm)
+	}
+	if len(ix.Artists) != 3 || ix.Artists[2].Name != "Bob Dylan" || ix.Artists[2].Index != "B" {
+		t.Error("unexpected artists:", ix.Artists)
+	}
+
+	// not modified:
+	d = `
+ "indexes": {"lastModified": 1237646084000}`
+	ix, err = parseGetIndexesResp([]byte(Jhead + d + "," + Jtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.Artists) != 0 || ix.LastModified.IsZero() {
+		t.Error("unexpected indexes:", ix)
+	}
+
+	// request:
+	var since string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since = r.URL.Query().Get("ifModifiedSince")
+		fmt.Fprint(w, Jhead+d+","+Jtail)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	if _, err := c.GetIndexes(time.Unix(1237646084, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if since != "1237646084000" {
+		t.Error(since, "≠", "1237646084000")
+	}
+
+	// error case:
+	j = []byte(Jhead + Jerr + "," + Jtail)
+	if _, err := parseGetIndexesResp(j); err == nil || err.Error() != errMsg {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestGetScanStatus(t *testing.T) {
+	d := `
+ "scanStatus": {"scanning": true, "count": 4680}`
+	j := []byte(Jhead + d + "," + Jtail)
+	if err := json.Unmarshal(j, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err := parseGetScanStatusResp(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Scanning || s.Count != 4680 {
+		t.Error(s, "≠", ScanStatus{true, 4680})
+	}
+
+	// error case:
+	j = []byte(Jhead + Jerr + "," + Jtail)
+	if _, err := parseGetScanStatusResp(j); err == nil || err.Error() != errMsg {
+		t.Error("unexpected error:", err)
+	}
+}
+
 func TestGetArtist(t *testing.T) {
 	// single album
 	name := "Dummy Disc"
@@ -218,12 +557,21 @@ func TestGetArtist(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if s[0].Id != 0 {
+	if s[0].Id != "0" {
 		t.Error("expected", 0, "found", s[0].Id)
 	}
 	if s[0].Name != name {
 		t.Error("expected", name, "found", s[0].Name)
 	}
+	if s[0].Artist != "DummyArtist" || s[0].ArtistId != "166" || s[0].SongCount != 14 || s[0].CoverArt != "al-511" {
+		t.Error("unexpected metadata:", s[0])
+	}
+	if s[0].Duration != 3411*time.Second {
+		t.Error(s[0].Duration, "≠", 3411*time.Second)
+	}
+	if want := time.Date(2013, 3, 18, 12, 21, 33, 0, time.UTC); !s[0].Created.Equal(want) {
+		t.Error(s[0].Created, "≠", want)
+	}
 
 	// multi albums
 	names := []string{"Very Bad Disc", "Greatest Hits"}
@@ -269,12 +617,32 @@ func TestGetArtist(t *testing.T) {
 			t.Error(a.Name, "≠", names[i])
 		}
 	}
+
+	// missing id:
+	d = `
+ "artist": {
+  "id": 13,
+  "album": {"name": "Anonymous"}
+ }`
+	if _, err := parseGetArtistResp([]byte(Jhead + d + "," + Jtail)); err == nil {
+		t.Error("expected error found nil")
+	}
+
+	// error case:
+	j = []byte(Jhead + Jerr + "," + Jtail)
+	if _, err := parseGetArtistResp(j); err != nil {
+		if err.Error() != errMsg {
+			t.Error("unexpected error:", err)
+		}
+	} else {
+		t.Error("expected error found nil")
+	}
 }
 
 func TestGetAlbum(t *testing.T) {
 	songs := []Song{
-		Song{Resource{1, "Track1"}, 1, "mp3"},
-		Song{Resource{2, "Track2"}, 2, "ogg"},
+		{Resource: Resource{"1", "Track1"}, Number: 1, Suffix: "mp3"},
+		{Resource: Resource{"2", "Track2"}, Number: 2, Suffix: "ogg"},
 	}
 	d := `
  "album": {
@@ -357,4 +725,311 @@ func TestGetAlbum(t *testing.T) {
 			t.Error(j.Number, "≠", songs[i].Suffix)
 		}
 	}
+	if s[1].Duration != 376*time.Second {
+		t.Error(s[1].Duration, "≠", 376*time.Second)
+	}
+	if s[1].Size != 8308552 || s[1].BitRate != 320 || s[1].ContentType != "audio/mpeg" {
+		t.Error("unexpected metadata:", s[1])
+	}
+	if s[1].Year != 1979 || s[1].Genre != "17" || s[1].Artist != "Rozzy" || s[1].Album != "Dummy Disc" {
+		t.Error("unexpected metadata:", s[1])
+	}
+	if s[1].Path != "A/B/2.m3" || s[1].AlbumId != "63" || s[1].ArtistId != "13" {
+		t.Error("unexpected metadata:", s[1])
+	}
+	if want := time.Date(2013, 3, 12, 11, 38, 16, 0, time.UTC); !s[1].Created.Equal(want) {
+		t.Error(s[1].Created, "≠", want)
+	}
+	if s[1].DiscNumber != 0 || s[1].PlayCount != 0 || s[1].CoverArt != "" {
+		t.Error("missing fields not zero:", s[1])
+	}
+
+	// OpenSubsonic extras:
+	d = `
+ "album": {
+  "id": "al-1",
+  "song": {
+   "id": "tr-1",
+   "title": "Intro",
+   "track": "3",
+   "discNumber": 2,
+   "suffix": "flac",
+   "created": "2023-01-02T03:04:05.678Z",
+   "playCount": 12,
+   "coverArt": "al-1",
+   "replayGain": {
+    "trackGain": -6.5,
+    "albumGain": -7.25,
+    "trackPeak": 0.98,
+    "albumPeak": 1
+   }
+  }
+ }`
+	s, err = parseGetAlbumResp([]byte(Jhead + d + "," + Jtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[0].Number != 3 || s[0].DiscNumber != 2 || s[0].PlayCount != 12 || s[0].CoverArt != "al-1" {
+		t.Error("unexpected metadata:", s[0])
+	}
+	if want := time.Date(2023, 1, 2, 3, 4, 5, 678e6, time.UTC); !s[0].Created.Equal(want) {
+		t.Error(s[0].Created, "≠", want)
+	}
+	if g := s[0].ReplayGain; g.TrackGain != -6.5 || g.AlbumGain != -7.25 || g.TrackPeak != 0.98 || g.AlbumPeak != 1 {
+		t.Error("unexpected replay gain:", g)
+	}
+
+	// bare minimum:
+	d = `
+ "album": {
+  "id": 2,
+  "song": {"id": 3}
+ }`
+	s, err = parseGetAlbumResp([]byte(Jhead + d + "," + Jtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[0].Id != "3" || s[0].Name != "" || s[0].Number != 0 || !s[0].Created.IsZero() {
+		t.Error("missing fields not zero:", s[0])
+	}
+
+	// single song:
+	d = `
+ "album": {
+  "id": 2,
+  "song": {
+   "id": 3,
+   "title": "Alone",
+   "track": 1,
+   "suffix": "flac"
+  }
+ }`
+	s, err = parseGetAlbumResp([]byte(Jhead + d + "," + Jtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[0].Id != "3" || s[0].Name != "Alone" {
+		t.Error("unexpected songs:", s)
+	}
+
+	// error case:
+	j = []byte(Jhead + Jerr + "," + Jtail)
+	if _, err := parseGetAlbumResp(j); err != nil {
+		if err.Error() != errMsg {
+			t.Error("unexpected error:", err)
+		}
+	} else {
+		t.Error("expected error found nil")
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		j   string
+		n   int
+		err bool
+	}{
+		{`[]`, 0, false},
+		{`null`, 0, false},
+		{`{"id": 1}`, 1, false},
+		{`[{"id": 1}, {"id": "two"}]`, 2, false},
+		{` [{"id": 1}]`, 1, false},
+		{`"oops"`, 0, true},
+		{`[{"id": true}]`, 0, true},
+	}
+	for _, tt := range tests {
+		var l list[artistEntry]
+		err := json.Unmarshal([]byte(tt.j), &l)
+		if tt.err {
+			if err == nil {
+				t.Error(tt.j, ": expected error found nil")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(tt.j, ": unexpected error:", err)
+		}
+		if len(l) != tt.n {
+			t.Error(tt.j, ":", len(l), "≠", tt.n)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		j, s string
+	}{
+		{`"Simon &amp; Garfunkel"`, "Simon & Garfunkel"},
+		{`"Guns N&#39; Roses"`, "Guns N' Roses"},
+		{`1979`, "1979"},
+		{`0.02`, "0.02"},
+		{`null`, ""},
+	}
+	for _, tt := range tests {
+		var s text
+		if err := json.Unmarshal([]byte(tt.j), &s); err != nil {
+			t.Error(tt.j, ": unexpected error:", err)
+		}
+		if string(s) != tt.s {
+			t.Error(s, "≠", tt.s)
+		}
+	}
+	var s text
+	if err := json.Unmarshal([]byte(`{}`), &s); err == nil {
+		t.Error("expected error found nil")
+	}
+}
+
+func TestIdent(t *testing.T) {
+	tests := []struct {
+		j, id string
+	}{
+		{`805`, "805"},
+		{`"al-511"`, "al-511"},
+		{`"0bJ1mqWnnoADi6dwylvbYu"`, "0bJ1mqWnnoADi6dwylvbYu"},
+		{`12345678901`, "12345678901"},
+	}
+	for _, tt := range tests {
+		var id ident
+		if err := json.Unmarshal([]byte(tt.j), &id); err != nil {
+			t.Error(tt.j, ": unexpected error:", err)
+		}
+		if string(id) != tt.id {
+			t.Error(id, "≠", tt.id)
+		}
+	}
+	var id ident
+	if err := json.Unmarshal([]byte(`[1]`), &id); err == nil {
+		t.Error("expected error found nil")
+	}
+}
+
+func TestStreamAt(t *testing.T) {
+	song := []byte("0123456789abcdefghij")
+	var ranges bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("estimateContentLength") != "" {
+			t.Error("estimated length asked:", r.URL)
+		}
+		if ranges {
+			http.ServeContent(w, r, "song.mp3", time.Time{}, bytes.NewReader(song))
+			return
+		}
+		w.Write(song) // transcoding: Range ignored
+	}))
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), "bob", "sesame", false)
+	for _, ranges = range []bool{true, false} {
+		for _, off := range []int64{0, 1, 10, 19, 20, 100} {
+			r, err := c.StreamAtContext(context.Background(), "1", 128, off)
+			if err != nil {
+				t.Fatal(ranges, off, err)
+			}
+			if r.Size != int64(len(song)) {
+				t.Error(ranges, off, ": size", r.Size, "≠", len(song))
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Error(ranges, off, err)
+			}
+			want := ""
+			if off < int64(len(song)) {
+				want = string(song[off:])
+			}
+			if string(b) != want {
+				t.Error(ranges, off, ":", string(b), "≠", want)
+			}
+		}
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	tests := []struct {
+		status int
+		ctype  string
+		body   string
+		err    string // "" if streamed
+		code   int
+	}{
+		{200, "audio/mpeg", "song", "", 0},
+		{200, "application/json; charset=utf-8", Jhead + `
+ "error": {"code": 70, "message": "Song not found"},` + Jtail, "Song not found", 70},
+		{200, "text/xml; charset=utf-8", Xhead + `
+ <error code="50" message="User is not authorized"/>` + Xtail, "User is not authorized", 50},
+		{500, "application/json", Jhead + Jerr + "," + Jtail, errMsg, 40},
+		{502, "text/html", "<html><body>Bad Gateway</body></html>", "stream: HTML page instead of a response (HTTP status 502)", 0},
+		{503, "text/plain", "busy", "stream: unexpected HTTP status 503 Service Unavailable", 0},
+		{200, "application/json", Jhead + Jtail, "stream: malformed response: application/json instead of a song", 0},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.ctype)
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		c := NewClient(strings.TrimPrefix(srv.URL, "http://"), "bob", "sesame", false)
+		r, err := c.Stream("1", 128)
+		srv.Close()
+		if tt.err == "" {
+			if err != nil {
+				t.Error(tt.ctype, "unexpected error:", err)
+				continue
+			}
+			b, _ := ioutil.ReadAll(r)
+			r.Close()
+			if string(b) != tt.body {
+				t.Error(string(b), "≠", tt.body)
+			}
+			continue
+		}
+		if err == nil {
+			r.Close()
+			t.Error(tt.status, tt.ctype, "expected error found nil")
+			continue
+		}
+		if err.Error() != tt.err {
+			t.Error(err, "≠", tt.err)
+		}
+		if e, ok := err.(*ReqError); tt.code != 0 && (!ok || e.Code != tt.code) {
+			t.Error("unexpected error:", err)
+		}
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		code int
+		err  error
+	}{
+		{0, nil},
+		{10, ErrMissingParameter},
+		{20, ErrVersion},
+		{30, ErrVersion},
+		{40, ErrWrongCredentials},
+		{41, ErrTokenUnsupported},
+		{50, ErrNotAuthorized},
+		{70, ErrNotFound},
+	}
+	all := []error{ErrMissingParameter, ErrVersion, ErrWrongCredentials, ErrTokenUnsupported, ErrNotAuthorized, ErrNotFound}
+	for _, tt := range tests {
+		d := fmt.Sprintf(`
+ "error": {"code": %d, "message": "%s", "helpUrl": "https://example.com/help"},`, tt.code, errMsg)
+		_, err := parsePingResp([]byte(Jhead + d + Jtail))
+		if err == nil {
+			t.Fatal(tt.code, "expected error found nil")
+		}
+		for _, e := range all {
+			if errors.Is(err, e) != (e == tt.err) {
+				t.Error(tt.code, ": errors.Is", e, "≠", e == tt.err)
+			}
+		}
+		wrapped := fmt.Errorf("could not load: %w", err)
+		if tt.err != nil && !errors.Is(wrapped, tt.err) {
+			t.Error(tt.code, ": wrapped error not matched")
+		}
+		if e, ok := err.(*ReqError); !ok || e.HelpURL != "https://example.com/help" || e.Error() != errMsg {
+			t.Error("unexpected error:", err)
+		}
+	}
 }
@@ -0,0 +1,138 @@
+package subsonic
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kind is the class of a failed call to the server.
+type Kind int
+
+const (
+	// KindNetwork is a failure to reach the server or to receive its
+	// response.
+	KindNetwork Kind = iota + 1
+	// KindStatus is an HTTP status other than 2xx.
+	KindStatus
+	// KindHTML is an HTML page instead of a response, as sent by a
+	// reverse proxy when the server is down.
+	KindHTML
+	// KindMalformed is a response that cannot be decoded.
+	KindMalformed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNetwork:
+		return "network error"
+	case KindStatus:
+		return "HTTP status error"
+	case KindHTML:
+		return "HTML page"
+	case KindMalformed:
+		return "malformed response"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// CallError is a failed call to the server, other than an error
+// reported by the server itself (see ReqError).
+type CallError struct {
+	Kind   Kind
+	Method string // API method, e.g. "getAlbum"
+	URL    string // requested URL, with the credentials redacted
+	Status int    // HTTP status, or 0 if no response was received
+	Err    error  // underlying error, if any
+
+	// RetryAfter is the delay before a new attempt asked by the
+	// server, if any.
+	RetryAfter time.Duration
+}
+
+func (e *CallError) Error() string {
+	var detail string
+	switch e.Kind {
+	case KindStatus:
+		detail = fmt.Sprintf("unexpected HTTP status %d %s", e.Status, http.StatusText(e.Status))
+	case KindHTML:
+		detail = "HTML page instead of a response"
+		if e.Status != 0 {
+			detail += fmt.Sprintf(" (HTTP status %d)", e.Status)
+		}
+	default:
+		detail = e.Kind.String()
+		if e.Err != nil {
+			detail += ": " + e.Err.Error()
+		}
+	}
+	return e.Method + ": " + detail
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// newCallError returns a CallError of the call of method at u. The URL
+// of a *url.Error is left out, as it holds the credentials.
+func newCallError(kind Kind, method, u string, status int, err error) *CallError {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+	return &CallError{Kind: kind, Method: method, URL: redact(u), Status: status, Err: err}
+}
+
+// secrets are the query parameters holding credentials.
+var secrets = []string{"p", "t", "s", "apiKey"}
+
+// redact returns u with the values of the credentials replaced.
+func redact(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	q := pu.Query()
+	for _, k := range secrets {
+		if q.Get(k) != "" {
+			q.Set(k, "REDACTED")
+		}
+	}
+	pu.RawQuery = q.Encode()
+	return pu.String()
+}
+
+// isHTML reports whether resp, whose body starts with data, is an HTML
+// page.
+func isHTML(resp *http.Response, data []byte) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/html" || strings.HasPrefix(http.DetectContentType(data), "text/html")
+}
+
+// checkPayload returns an error if data is neither valid JSON nor
+// well-formed XML, as chosen by decode.
+func checkPayload(data []byte) error {
+	d := bytes.TrimSpace(data)
+	if len(d) == 0 || d[0] != '<' {
+		if !json.Valid(d) {
+			return errors.New("invalid JSON")
+		}
+		return nil
+	}
+	dec := xml.NewDecoder(bytes.NewReader(d))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package subsonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		ctype  string
+		body   string
+		kind   Kind
+	}{
+		{"status", 503, "text/plain", "Service Unavailable", KindStatus},
+		{"empty status", 500, "", "", KindStatus},
+		{"proxy page", 502, "text/html", "<html><head><title>502 Bad Gateway</title></head></html>", KindHTML},
+		{"login page", 200, "", "<!DOCTYPE html><html><body>Sign in</body></html>", KindHTML},
+		{"malformed JSON", 200, "application/json", `{"subsonic-response": {"status": "ok", broken`, KindMalformed},
+		{"malformed XML", 200, "text/xml", Xhead + `<artists>`, KindMalformed},
+	}
+	for _, tt := range tests {
+		var formats []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			formats = append(formats, r.URL.Query().Get("f"))
+			if tt.ctype != "" {
+				w.Header().Set("Content-Type", tt.ctype)
+			}
+			w.WriteHeader(tt.status)
+			fmt.Fprint(w, tt.body)
+		}))
+		c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+		_, err := c.GetAlbum("42")
+		ts.Close()
+		var ce *CallError
+		if !errors.As(err, &ce) {
+			t.Error(tt.name, ": unexpected error:", err)
+			continue
+		}
+		if ce.Kind != tt.kind || ce.Method != "getAlbum" || ce.Status != tt.status {
+			t.Error(tt.name, ":", ce.Kind, ce.Method, ce.Status, "≠", tt.kind, "getAlbum", tt.status)
+		}
+		if !strings.HasPrefix(ce.URL, ts.URL+"/rest/getAlbum.view?") || !strings.Contains(ce.URL, "id=42") {
+			t.Error(tt.name, ": unexpected URL", ce.URL)
+		}
+		if !strings.HasPrefix(err.Error(), "getAlbum: ") {
+			t.Error(tt.name, ": unexpected message", err)
+		}
+		// only malformed payloads fall back to XML:
+		want := "json"
+		if tt.kind == KindMalformed {
+			want = "json xml"
+		}
+		if strings.Join(formats, " ") != want {
+			t.Error(tt.name, ":", formats, "≠", want)
+		}
+	}
+}
+
+func TestCallErrorServer(t *testing.T) {
+	// an error reported by the server along with an error status:
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, Jhead+`"error": {"code": 70, "message": "Album not found"},`+Jtail)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	_, err := c.GetAlbum("42")
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestCallErrorNetwork(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	_, err := c.GetArtists()
+	var ce *CallError
+	if !errors.As(err, &ce) || ce.Kind != KindNetwork || ce.Status != 0 {
+		t.Fatal("unexpected error:", err)
+	}
+	if strings.Contains(err.Error(), "sesame") || strings.Contains(err.Error(), "736573616d65") {
+		t.Error("credentials in message:", err)
+	}
+
+	block := make(chan struct{})
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+	c = NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.GetArtistsContext(ctx)
+	if !errors.As(err, &ce) || ce.Kind != KindNetwork || !errors.Is(err, context.Canceled) {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	for _, c := range []*Client{
+		NewClient("example.com", "bob", "sesame", false),
+		NewAPIKeyClient("example.com", "s3cr3t", false),
+	} {
+		for _, token := range []bool{false, true} {
+			c.token = token
+			u := redact(c.reqURL("getAlbum", nil))
+			for _, secret := range []string{"sesame", "736573616d65", "s3cr3t"} {
+				if strings.Contains(u, secret) {
+					t.Error("secret in", u)
+				}
+			}
+			if !strings.Contains(u, "=REDACTED") {
+				t.Error("nothing redacted:", u)
+			}
+			if !strings.Contains(u, "c="+ClientName) {
+				t.Error("parameters lost:", u)
+			}
+		}
+	}
+	u := redact(NewClient("example.com", "bob", "sesame", false).reqURL("getAlbum", nil))
+	if !strings.Contains(u, "u=bob") {
+		t.Error("username redacted:", u)
+	}
+}
@@ -0,0 +1,160 @@
+package subsonic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limits bound the load the client puts on the server. Zero values
+// mean no limit.
+type Limits struct {
+	Calls   int     // concurrent API calls
+	Rate    float64 // API calls per second, retries included
+	Burst   int     // API calls allowed at once above Rate; at least 1
+	Streams int     // concurrent song transfers, until closed
+}
+
+// ErrBusy is returned by TryStreamAtContext when no stream can be
+// spared.
+var ErrBusy = errors.New("no stream available")
+
+// SetLimits sets the limits of the client, which by default has none.
+// It must be called before the client is used. Calls wait for their
+// turn until their context is done.
+func (c *Client) SetLimits(l Limits) {
+	c.calls, c.streams, c.bucket = nil, nil, nil
+	if l.Calls > 0 {
+		c.calls = make(sem, l.Calls)
+	}
+	if l.Streams > 0 {
+		c.streams = make(sem, l.Streams)
+	}
+	if l.Rate > 0 {
+		burst := math.Max(1, float64(l.Burst))
+		c.bucket = &bucket{rate: l.Rate, burst: burst, tokens: burst, last: time.Now()}
+	}
+}
+
+// limit calls fetch within the limits of the client.
+func (c *Client) limit(ctx context.Context, method, u string) ([]byte, error) {
+	if err := c.bucket.wait(ctx); err != nil {
+		return nil, newCallError(KindNetwork, method, u, 0, err)
+	}
+	if err := c.calls.acquire(ctx); err != nil {
+		return nil, newCallError(KindNetwork, method, u, 0, err)
+	}
+	defer c.calls.release()
+	return c.fetch(ctx, method, u)
+}
+
+// stream takes a stream slot, returning the function releasing it. A
+// spare transfer, which can be done later, does not wait for a slot: it
+// fails with ErrBusy unless it can take one at once and still leave
+// another free for the others.
+func (c *Client) stream(ctx context.Context, spare bool) (func(), error) {
+	if !spare {
+		if err := c.streams.acquire(ctx); err != nil {
+			return nil, err
+		}
+		return c.streams.release, nil
+	}
+	// take two slots, giving one back: one is left free
+	if !c.streams.try() {
+		return nil, ErrBusy
+	}
+	if !c.streams.try() {
+		c.streams.release()
+		return nil, ErrBusy
+	}
+	c.streams.release()
+	return c.streams.release, nil
+}
+
+// sem is a counting semaphore; nil is unlimited.
+type sem chan struct{}
+
+func (s sem) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// try acquires s if it can without waiting.
+func (s sem) try() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s sem) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// bucket is a token bucket rate limiter.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64 // maximum tokens
+	tokens float64 // negative when reserved by waiting calls
+	last   time.Time
+}
+
+// wait takes a token, waiting for it if needed, unless ctx is done
+// first.
+func (b *bucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	d := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++ // give the reservation back
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// releaser is a transfer releasing its stream slot once closed.
+type releaser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
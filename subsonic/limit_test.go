@@ -0,0 +1,161 @@
+package subsonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCallLimit(t *testing.T) {
+	var mu sync.Mutex
+	n, max := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n++
+		if n > max {
+			max = n
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		n--
+		mu.Unlock()
+		fmt.Fprint(w, Jhead+Jtail)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	c.SetLimits(Limits{Calls: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Ping(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max != 2 {
+		t.Error(max, "concurrent calls ≠", 2)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, Jhead+Jtail)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	c.SetLimits(Limits{Rate: 50, Burst: 2})
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		if err := c.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 2 at once, then 5 at 20ms intervals
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Error("rate not limited:", d)
+	}
+
+	// waiting cancelled:
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	c.SetLimits(Limits{Rate: 0.001})
+	c.Ping()
+	if err := c.PingContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/ping.view") {
+			fmt.Fprint(w, Jhead+Jtail)
+			return
+		}
+		w.Write([]byte("song"))
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	c.SetLimits(Limits{Calls: 1, Streams: 1})
+	r, err := c.Stream("1", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// API calls have their own limit:
+	if err := c.Ping(); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.StreamContext(ctx, "2", 128); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("stream limit not enforced:", err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	r.Close() // released once
+	r, err = c.Stream("2", 128)
+	if err != nil {
+		t.Fatal("stream slot not released:", err)
+	}
+	r.Close()
+	if len(c.streams) != 0 {
+		t.Error(len(c.streams), "stream slots held")
+	}
+}
+
+func TestSpareStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("song"))
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	ctx := context.Background()
+	r, err := c.TryStreamAtContext(ctx, "1", 128, 0)
+	if err != nil {
+		t.Fatal("unlimited:", err)
+	}
+	r.Close()
+
+	c.SetLimits(Limits{Streams: 1})
+	if _, err := c.TryStreamAtContext(ctx, "1", 128, 0); err != ErrBusy {
+		t.Error("last stream taken:", err)
+	}
+
+	c.SetLimits(Limits{Streams: 3})
+	r, err = c.TryStreamAtContext(ctx, "1", 128, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := c.TryStreamAtContext(ctx, "2", 128, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TryStreamAtContext(ctx, "3", 128, 0); err != ErrBusy {
+		t.Error("last stream taken:", err)
+	}
+	r3, err := c.StreamAtContext(ctx, "3", 128, 0)
+	if err != nil {
+		t.Fatal("last stream not left:", err)
+	}
+	r.Close()
+	r.Close() // released once
+	if _, err := c.TryStreamAtContext(ctx, "4", 128, 0); err != ErrBusy {
+		t.Error("last stream taken:", err)
+	}
+	r2.Close()
+	r3.Close()
+	if len(c.streams) != 0 {
+		t.Error(len(c.streams), "stream slots held")
+	}
+}
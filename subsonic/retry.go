@@ -0,0 +1,110 @@
+package subsonic
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy tells how the API calls failing with a transient error
+// are repeated: on network errors, and on the HTTP statuses telling the
+// server is temporarily unavailable. All the API methods are reads, so
+// repeating them is safe. Song transfers are not repeated.
+type RetryPolicy struct {
+	Attempts int           // total attempts; 1 or less for no retry
+	MinDelay time.Duration // delay before the first retry, doubled at each next one
+	MaxDelay time.Duration // maximum delay, even if the server asks for a longer one
+}
+
+// SetRetryPolicy sets the retry policy of the client, which by default
+// does not retry. The context of a call bounds all of its attempts.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.mu.Lock()
+	c.retry = p
+	c.mu.Unlock()
+}
+
+// call calls the given API method like fetch, retrying as told by the
+// retry policy.
+func (c *Client) call(ctx context.Context, method string, q url.Values) ([]byte, error) {
+	c.mu.Lock()
+	p := c.retry
+	c.mu.Unlock()
+	for i := 1; ; i++ {
+		data, err := c.limit(ctx, method, c.reqURL(method, q))
+		if err == nil || i >= p.Attempts || !retryable(err) {
+			return data, err
+		}
+		t := time.NewTimer(p.delay(i, err))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		}
+	}
+}
+
+// delay returns the delay before the retry following the given failed
+// attempt: the one asked by the server, or an exponential backoff with
+// jitter, between half and all of it.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	var ce *CallError
+	if errors.As(err, &ce) && ce.RetryAfter > 0 {
+		if p.MaxDelay > 0 && ce.RetryAfter > p.MaxDelay {
+			return p.MaxDelay
+		}
+		return ce.RetryAfter
+	}
+	d := p.MinDelay << uint(attempt-1)
+	if d <= 0 || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable reports whether err is a failure which may not happen
+// again: a network error, except the cancellation of the call, or an
+// HTTP status telling the server is temporarily unavailable.
+func retryable(err error) bool {
+	var ce *CallError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	switch ce.Kind {
+	case KindNetwork:
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	case KindStatus, KindHTML:
+		switch ce.Status {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the delay asked by the Retry-After header of resp,
+// or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,133 @@
+package subsonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		failures int // before succeeding
+		calls    int
+		ok       bool
+	}{
+		{"transient", 503, "", 2, 3, true},
+		{"proxy page", 502, "<html><body>Bad Gateway</body></html>", 1, 2, true},
+		{"too many", 503, "", 5, 3, false},
+		{"not found", 404, "", 1, 1, false},
+		{"server error", 200, Jhead + Jerr + "," + Jtail, 1, 1, false},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			calls++
+			n := calls
+			mu.Unlock()
+			if n <= tt.failures {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+				return
+			}
+			fmt.Fprint(w, Jhead+Jtail)
+		}))
+		c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+		c.SetRetryPolicy(RetryPolicy{Attempts: 3, MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+		err := c.Ping()
+		ts.Close()
+		if (err == nil) != tt.ok {
+			t.Error(tt.name, ": unexpected error:", err)
+		}
+		if calls != tt.calls {
+			t.Error(tt.name, ":", calls, "calls ≠", tt.calls)
+		}
+	}
+}
+
+func TestRetryDefault(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	if err := c.Ping(); err == nil || calls != 1 {
+		t.Error("retried by default:", err, calls)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	c := NewClient(strings.TrimPrefix(ts.URL, "http://"), "bob", "sesame", false)
+	c.SetRetryPolicy(RetryPolicy{Attempts: 5, MinDelay: time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := c.PingContext(ctx)
+	var ce *CallError
+	if !errors.As(err, &ce) || ce.Status != 429 || ce.RetryAfter != time.Hour {
+		t.Error("unexpected error:", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("retry not cancelled, returned after", d)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, MinDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for j := 0; j < 20; j++ {
+			if d := p.delay(i+1, errors.New("x")); d < max/2 || d > max {
+				t.Error("attempt", i+1, ":", d, "not in", max/2, max)
+			}
+		}
+	}
+	asked := &CallError{Kind: KindStatus, Status: 503, RetryAfter: 300 * time.Millisecond}
+	if d := p.delay(1, asked); d != asked.RetryAfter {
+		t.Error(d, "≠", asked.RetryAfter)
+	}
+	asked.RetryAfter = time.Minute
+	if d := p.delay(1, asked); d != p.MaxDelay {
+		t.Error(d, "≠", p.MaxDelay)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 50 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if d := retryAfter(resp); d < tt.min || d > tt.max {
+			t.Error(tt.header, ":", d, "not in", tt.min, tt.max)
+		}
+	}
+}
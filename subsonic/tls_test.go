@@ -0,0 +1,89 @@
+package subsonic
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTLSServer(t *testing.T) (*httptest.Server, string) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, Jhead+Jtail)
+	}))
+	cafile := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(cafile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, cafile
+}
+
+func TestTLS(t *testing.T) {
+	srv, cafile := newTLSServer(t)
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	hexpin := hex.EncodeToString(sum[:])
+	colonpin := strings.ToUpper(hexpin[:2]) + ":" + hexpin[2:]
+	b64pin := base64.StdEncoding.EncodeToString(sum[:])
+	badpin := strings.Repeat("00", sha256.Size)
+
+	tests := []struct {
+		cafile, pin string
+		insecure    bool
+		ok          bool
+	}{
+		{"", "", false, false}, // self-signed, rejected by default
+		{cafile, "", false, true},
+		{cafile, hexpin, false, true},
+		{cafile, colonpin, false, true},
+		{cafile, b64pin, false, true},
+		{cafile, badpin, false, false},
+		{"", hexpin, false, false}, // the pin does not replace verification
+		{"", "", true, true},
+		{"", b64pin, true, true},
+		{"", badpin, true, false},
+	}
+	host := strings.TrimPrefix(srv.URL, "https://")
+	for i, tt := range tests {
+		tc, err := TLSConfig(tt.cafile, tt.pin, tt.insecure)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		c := NewClient(host, "bob", "sesame", true)
+		c.SetTLSConfig(tc)
+		err = c.Ping()
+		if tt.ok && err != nil {
+			t.Error(i, "unexpected error:", err)
+		}
+		if !tt.ok && err == nil {
+			t.Error(i, "expected error found nil")
+		}
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := TLSConfig(filepath.Join(dir, "missing.pem"), "", false); err == nil {
+		t.Error("missing CA file: expected error found nil")
+	}
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("nothing to see here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSConfig(empty, "", false); err == nil {
+		t.Error("empty CA file: expected error found nil")
+	}
+	for _, pin := range []string{"xyz", "abcd", strings.Repeat("0", 63)} {
+		if _, err := TLSConfig("", pin, false); err == nil {
+			t.Error("pin", pin, ": expected error found nil")
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package subsonic
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	Xhead = `<?xml version="1.0" encoding="UTF-8"?>
+<subsonic-response xmlns="http://subsonic.org/restapi" status="ok" version="1.8.0">`
+
+	Xtail = `
+</subsonic-response>`
+
+	Xerr = `
+ <error code="40" message="` + errMsg + `"/>`
+)
+
+func TestXMLPing(t *testing.T) {
+	// successful case:
+	x := []byte(Xhead + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	v, err := parsePingResp(x)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if v != "1.8.0" {
+		t.Error(v, "≠", "1.8.0")
+	}
+
+	// error case:
+	x = []byte(Xhead + Xerr + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	if _, err := parsePingResp(x); err != nil {
+		if err.Error() != errMsg {
+			t.Error("unexpected error:", err)
+		}
+		if e, ok := err.(*ReqError); !ok || e.Code != 40 || !errors.Is(err, ErrWrongCredentials) {
+			t.Error("unexpected error:", err)
+		}
+	} else {
+		t.Error("expected error found nil")
+	}
+
+	// OpenSubsonic help:
+	x = []byte(Xhead + `
+ <error code="70" message="Album not found" helpUrl="https://example.com/help"/>` + Xtail)
+	_, err = parsePingResp(x)
+	if e, ok := err.(*ReqError); !ok || e.HelpURL != "https://example.com/help" || !errors.Is(err, ErrNotFound) {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestXMLGetOpenSubsonicExtensions(t *testing.T) {
+	d := `
+ <openSubsonicExtensions name="transcodeOffset"><versions>1</versions></openSubsonicExtensions>
+ <openSubsonicExtensions name="apiKeyAuthentication"><versions>1</versions></openSubsonicExtensions>`
+	e, err := parseGetOpenSubsonicExtensionsResp([]byte(Xhead + d + Xtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 2 {
+		t.Fatal(len(e), "≠", 2)
+	}
+	if e[1].Name != "apiKeyAuthentication" || len(e[1].Versions) != 1 || e[1].Versions[0] != 1 {
+		t.Error("unexpected extension:", e[1])
+	}
+}
+
+func TestXMLGetArtists(t *testing.T) {
+	// common case:
+	names := []string{"A1", "A2", "Kwyjibo"}
+	d := `
+ <artists>
+  <index name="A">
+   <artist id="0" name="` + names[0] + `" albumCount="7"/>
+   <artist id="1" name="` + names[1] + `" coverArt="ar-222" albumCount="1"/>
+  </index>
+  <index name="K">
+   <artist id="2" name="` + names[2] + `" coverArt="ar-23" albumCount="14"/>
+  </index>
+ </artists>`
+	x := []byte(Xhead + d + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err := parseGetArtistsResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(names) {
+		t.Fatal(len(s), "≠", len(names))
+	}
+	for i, a := range s {
+		if a.Id != strconv.Itoa(i) {
+			t.Error(a.Id, "≠", i)
+		}
+		if a.Name != names[i] {
+			t.Error(a.Name, "≠", names[i])
+		}
+	}
+
+	// numbers and entities in name:
+	names = []string{"42", "0.02", "Simon & Garfunkel"}
+	d = `
+ <artists>
+  <index name="#">
+   <artist id="0" name="42" albumCount="7"/>
+   <artist id="1" name="0.02" albumCount="7"/>
+   <artist id="2" name="Simon &amp;amp; Garfunkel" albumCount="1"/>
+  </index>
+ </artists>`
+	x = []byte(Xhead + d + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err = parseGetArtistsResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(names) {
+		t.Fatal(len(s), "≠", len(names))
+	}
+	for i, a := range s {
+		if a.Name != names[i] {
+			t.Error(a.Name, "≠", names[i])
+		}
+	}
+
+	// string ids (OpenSubsonic):
+	d = `
+ <artists>
+  <index name="N">
+   <artist id="2VSxJwFLjwZ8PPbhSXqQYC" name="Nirvana"/>
+  </index>
+ </artists>`
+	s, err = parseGetArtistsResp([]byte(Xhead + d + Xtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[0].Id != "2VSxJwFLjwZ8PPbhSXqQYC" {
+		t.Error("unexpected artists:", s)
+	}
+
+	// error case:
+	x = []byte(Xhead + Xerr + Xtail)
+	if _, err := parseGetArtistsResp(x); err != nil {
+		if err.Error() != errMsg {
+			t.Error("unexpected error:", err)
+		}
+	} else {
+		t.Error("expected error found nil")
+	}
+}
+
+func TestXMLGetIndexes(t *testing.T) {
+	d := `
+ <indexes lastModified="1237646084000" ignoredArticles="The El La Los Las Le Les">
+  <shortcut id="11" name="Audio books"/>
+  <index name="A">
+   <artist id="1" name="ABBA"/>
+   <artist id="2" name="Alanis Morisette"/>
+  </index>
+  <index name="B">
+   <artist id="3" name="Bob Dylan"/>
+  </index>
+  <child id="111" parent="11" title="Dancing Queen" isDir="false"/>
+ </indexes>`
+	x := []byte(Xhead + d + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	ix, err := parseGetIndexesResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm := time.Unix(1237646084, 0); !ix.LastModified.Equal(tm) {
+		t.Error(ix.LastModified, "≠", tm)
+	}
+	if len(ix.Artists) != 3 || ix.Artists[2].Name != "Bob Dylan" || ix.Artists[2].Index != "B" {
+		t.Error("unexpected artists:", ix.Artists)
+	}
+}
+
+func TestXMLGetScanStatus(t *testing.T) {
+	x := []byte(Xhead + `
+ <scanStatus scanning="true" count="4680"/>` + Xtail)
+	s, err := parseGetScanStatusResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Scanning || s.Count != 4680 {
+		t.Error(s, "≠", ScanStatus{true, 4680})
+	}
+}
+
+func TestXMLGetArtist(t *testing.T) {
+	names := []string{"Very Bad Disc", "Greatest Hits"}
+	d := `
+ <artist id="13" name="Rozzy" albumCount="2">
+  <album id="0" name="` + names[0] + `" artist="Rozzy" artistId="13" songCount="10" duration="2517" created="2013-03-12T11:32:55"/>
+  <album id="1" name="` + names[1] + `" artist="Rozzy" artistId="13" songCount="9" duration="2421" created="2013-03-12T11:33:43"/>
+ </artist>`
+	x := []byte(Xhead + d + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err := parseGetArtistResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(names) {
+		t.Fatal(len(s), "≠", len(names))
+	}
+	for i, a := range s {
+		if a.Id != strconv.Itoa(i) {
+			t.Error(a.Id, "≠", i)
+		}
+		if a.Name != names[i] {
+			t.Error(a.Name, "≠", names[i])
+		}
+	}
+}
+
+func TestXMLGetAlbum(t *testing.T) {
+	songs := []Song{
+		{Resource: Resource{"1", "Track1"}, Number: 1, Suffix: "mp3"},
+		{Resource: Resource{"2", "Track2"}, Number: 2, Suffix: "ogg"},
+	}
+	d := `
+ <album id="1" name="Dummy Disc" artist="Rozzy" artistId="13" songCount="2" duration="2484" created="2013-03-12T11:37:46">`
+	for _, s := range songs {
+		d += fmt.Sprintf(`
+  <song id="%s" parent="805" title="%s" album="Dummy Disc" artist="Rozzy" isDir="false" track="%d" year="1979" genre="17" size="8308552" contentType="audio/mpeg" suffix="%s" duration="207" bitRate="320" path="A/B/%s.mp3" isVideo="false" created="2013-03-12T11:36:04" albumId="63" artistId="13" type="music"/>`,
+			s.Id, s.Name, s.Number, s.Suffix, s.Id)
+	}
+	d += `
+ </album>`
+	x := []byte(Xhead + d + Xtail)
+	if err := xml.Unmarshal(x, &buf); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	s, err := parseGetAlbumResp(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != len(songs) {
+		t.Fatal(len(s), "≠", len(songs))
+	}
+	for i, j := range s {
+		if j.Id != songs[i].Id || j.Name != songs[i].Name || j.Number != songs[i].Number || j.Suffix != songs[i].Suffix {
+			t.Error(j, "≠", songs[i])
+		}
+		if j.Size != 8308552 || j.Genre != "17" || j.Year != 1979 || j.AlbumId != "63" {
+			t.Error("unexpected metadata:", j)
+		}
+		if want := time.Date(2013, 3, 12, 11, 36, 4, 0, time.UTC); !j.Created.Equal(want) {
+			t.Error(j.Created, "≠", want)
+		}
+	}
+
+	// replay gain (OpenSubsonic):
+	d = `
+ <album id="1" name="Dummy Disc">
+  <song id="1" title="Track1" track="1" suffix="flac" created="2023-01-02T03:04:05.678Z">
+   <replayGain trackGain="-6.5" albumGain="-7.25" trackPeak="0.98"/>
+  </song>
+ </album>`
+	s, err = parseGetAlbumResp([]byte(Xhead + d + Xtail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := s[0].ReplayGain; g.TrackGain != -6.5 || g.AlbumGain != -7.25 || g.TrackPeak != 0.98 {
+		t.Error("unexpected replay gain:", g)
+	}
+}
+
+func TestFormatFallback(t *testing.T) {
+	var formats []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := r.URL.Query().Get("f")
+		formats = append(formats, f)
+		if f == "json" {
+			fmt.Fprint(w, `{"subsonic-response": {"status": "ok", broken`)
+			return
+		}
+		fmt.Fprint(w, Xhead+`<artists><index name="A"><artist id="1" name="ABBA"/></index></artists>`+Xtail)
+	}))
+	defer srv.Close()
+	c := NewClient(strings.TrimPrefix(srv.URL, "http://"), "bob", "sesame", false)
+	for i := 0; i < 2; i++ {
+		s, err := c.GetArtists()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s) != 1 || s[0].Name != "ABBA" {
+			t.Error("unexpected artists:", s)
+		}
+	}
+	if want := "json xml xml"; strings.Join(formats, " ") != want {
+		t.Error(formats, "≠", want)
+	}
+
+	// no fallback when the format is forced:
+	formats = nil
+	c = NewClient(strings.TrimPrefix(srv.URL, "http://"), "bob", "sesame", false)
+	c.SetFormat(FormatJSON)
+	if _, err := c.GetArtists(); err == nil {
+		t.Error("expected error found nil")
+	}
+	if want := "json"; strings.Join(formats, " ") != want {
+		t.Error(formats, "≠", want)
+	}
+}
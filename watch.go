@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bitbucket.org/gall0ws/subsonicfs/subsonic"
+
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// watcher detects the changes of the library on the server.
+type watcher struct {
+	last  time.Time // last modification seen
+	scans bool      // the server may support getScanStatus
+}
+
+// changed reports whether the library was modified since the previous
+// call, or since last for the first one: getIndexes only sends the full
+// index if it was. While the server is scanning the library, changes are
+// reported once the scan is over.
+func (w *watcher) changed(ctx context.Context) (bool, error) {
+	if w.scans {
+		s, err := client.GetScanStatusContext(ctx)
+		switch {
+		case unsupported(err):
+			w.scans = false
+		case err != nil:
+			return false, err
+		case s.Scanning:
+			return false, nil
+		}
+	}
+	ix, err := client.GetIndexesContext(ctx, w.last)
+	if err != nil {
+		return false, err
+	}
+	if !ix.LastModified.After(w.last) {
+		return false, nil
+	}
+	w.last = ix.LastModified
+	return true, nil
+}
+
+// unsupported reports whether err tells the called method is unknown to
+// the server: an error telling the server is too old or the method is
+// not found, or an HTTP status telling the method does not exist, as
+// sent by servers older than the method or by a proxy in front of them.
+// Other errors, e.g. a failure during a scan, may not happen again.
+func unsupported(err error) bool {
+	if errors.Is(err, subsonic.ErrVersion) || errors.Is(err, subsonic.ErrNotFound) {
+		return true
+	}
+	var ce *subsonic.CallError
+	return errors.As(err, &ce) && (ce.Status == http.StatusNotFound || ce.Status == http.StatusNotImplemented)
+}
+
+// watch checks the library for changes since the time given, then
+// every d, reloading root when it changed. The artists, and the albums whose number of songs changed,
+// are reloaded in turn when next accessed.
+func watch(root *RootDir, since time.Time, d time.Duration) {
+	w := &watcher{last: since, scans: true}
+	for {
+		ctx, cancel := reqContext()
+		changed, err := w.changed(ctx)
+		if err != nil {
+			log.Printf("could not check the library for changes: %s\n", err)
+		} else if changed {
+			root.changed(ctx) // failures logged and retried
+		}
+		cancel()
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	okResp  = `{"subsonic-response":{"status":"ok","version":"1.15.0",%s}}`
+	errResp = `{"subsonic-response":{"status":"failed","version":"1.8.0","error":{"code":%d,"message":"no"}}}`
+)
+
+func TestWatcher(t *testing.T) {
+	var mu sync.Mutex
+	modified, scanning, code, status := 1000, false, -1, 0
+	var since string
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch path.Base(r.URL.Path) {
+		case "getScanStatus.view":
+			if status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+			if code >= 0 {
+				fmt.Fprintf(w, errResp, code)
+				return
+			}
+			fmt.Fprintf(w, okResp, fmt.Sprintf(`"scanStatus":{"scanning":%v,"count":1}`, scanning))
+		case "getIndexes.view":
+			since = r.URL.Query().Get("ifModifiedSince")
+			fmt.Fprintf(w, okResp, fmt.Sprintf(`"indexes":{"lastModified":%d}`, modified))
+		}
+	})
+	set := func(f func()) {
+		mu.Lock()
+		f()
+		mu.Unlock()
+	}
+	ctx := context.Background()
+	w := &watcher{last: time.UnixMilli(1000), scans: true}
+	if changed, err := w.changed(ctx); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	if since != "1000" {
+		t.Error("full index asked:", since)
+	}
+	set(func() { modified, scanning = 2000, true })
+	if changed, _ := w.changed(ctx); changed {
+		t.Error("change reported during a scan")
+	}
+	set(func() { scanning = false })
+	if changed, _ := w.changed(ctx); !changed {
+		t.Error("change not reported")
+	}
+	if changed, _ := w.changed(ctx); changed {
+		t.Error("change reported twice")
+	}
+	// failures which may not happen again:
+	for _, c := range []int{0, 40, 50} {
+		set(func() { code = c })
+		if _, err := w.changed(ctx); err == nil || !w.scans {
+			t.Error(c, ": getScanStatus taken for unsupported:", err)
+		}
+	}
+	set(func() { modified, code = 3000, 70 })
+	if changed, err := w.changed(ctx); err != nil || !changed || w.scans {
+		t.Error("change not reported without getScanStatus:", err)
+	}
+	set(func() { code = -1 })
+
+	// unknown to a proxy:
+	for _, st := range []int{http.StatusNotFound, http.StatusNotImplemented} {
+		w.scans = true
+		set(func() { modified, status = modified+1000, st })
+		if changed, err := w.changed(ctx); err != nil || !changed || w.scans {
+			t.Error(st, ": change not reported without getScanStatus:", err)
+		}
+	}
+	w.scans = true
+	set(func() { status = http.StatusInternalServerError })
+	if _, err := w.changed(ctx); err == nil || !w.scans {
+		t.Error("server failure taken for an unsupported method:", err)
+	}
+}
+
+func TestRootChanges(t *testing.T) {
+	var mu sync.Mutex
+	artists := []string{`{"id":"1","name":"a","albumCount":1}`, `{"id":"2","name":"b","albumCount":1}`}
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, okResp, `"artists":{"index":[{"name":"A","artist":[`+strings.Join(artists, ",")+`]}]}`)
+	})
+	if err := parseTemplates(); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	defer func(s string) { *idxmode = s }(*idxmode)
+	*idxmode = "server"
+	root := &RootDir{}
+	root.Add(nil, "/", owner, nil, dirperm, root)
+	ctx := context.Background()
+	if err := root.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dir := func(name string) *ArtistDir {
+		index := root.Find("a")
+		if index == nil {
+			t.Fatal("index not found")
+		}
+		f := index.Find(name)
+		if f == nil {
+			return nil
+		}
+		return f.Ops.(*ArtistDir)
+	}
+	a, b := dir("a"), dir("b")
+	if a == nil || b == nil {
+		t.Fatal("artists not loaded")
+	}
+	for _, d := range []*ArtistDir{a, b} {
+		d.loading.Lock()
+		d.loaded = time.Now() // pretend loaded
+		d.loading.Unlock()
+	}
+
+	mu.Lock()
+	artists = []string{artists[0], `{"id":"2","name":"b","albumCount":2}`, `{"id":"3","name":"c"}`}
+	mu.Unlock()
+	root.expire()
+	if err := root.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if dir("a") != a || dir("b") != b || dir("c") == nil {
+		t.Error("artists not updated in place")
+	}
+	if a.loaded.IsZero() || !b.loaded.IsZero() {
+		t.Error("wrong artists expired:", a.loaded, b.loaded)
+	}
+}
+
+func TestAlbumChanges(t *testing.T) {
+	var mu sync.Mutex
+	songs := 1
+	newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch path.Base(r.URL.Path) {
+		case "getArtists.view":
+			fmt.Fprintf(w, okResp, `"artists":{"index":[{"name":"A","artist":[{"id":"1","name":"a","albumCount":1}]}]}`)
+		case "getArtist.view":
+			fmt.Fprintf(w, okResp, fmt.Sprintf(`"artist":{"id":"1","name":"a","album":[{"id":"10","name":"x","songCount":%d}]}`, songs))
+		case "getAlbum.view":
+			var list []string
+			for i := 1; i <= songs; i++ {
+				list = append(list, fmt.Sprintf(`{"id":"%d","title":"t%d","track":%d,"suffix":"mp3"}`, i, i, i))
+			}
+			fmt.Fprintf(w, okResp, `"album":{"id":"10","song":[`+strings.Join(list, ",")+`]}`)
+		}
+	})
+	if err := parseTemplates(); err != nil {
+		t.Fatal("EPIC FAIL: TEST IS BROKEN:", err)
+	}
+	defer func(s string) { *idxmode = s }(*idxmode)
+	*idxmode = "server"
+	root := &RootDir{}
+	root.Add(nil, "/", owner, nil, dirperm, root)
+	ctx := context.Background()
+	if err := root.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	artist := root.Find("a").Find("a").Ops.(*ArtistDir)
+	if err := artist.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	album := artist.Find("x").Ops.(*AlbumDir)
+	if err := album.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	songs = 2 // a track added, no new album
+	mu.Unlock()
+	if err := root.changed(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := artist.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := album.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if album.Find("02_t2.mp3") == nil {
+		t.Error("added song not listed")
+	}
+}